@@ -0,0 +1,331 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const archiveSeparator = "!/"
+
+//-- Manifest CSVs that are picked up automatically from the root of a crawled archive
+var archiveManifests = []struct {
+	name string
+	flag *string
+}{
+	{"docs_main.csv", &flags.configCSVMain},
+	{"manifest.csv", &flags.configCSVMain},
+	{"docs_shares.csv", &flags.configCSVShares},
+	{"docs_collections.csv", &flags.configCSVCollections},
+	{"docs_tags.csv", &flags.configCSVTags},
+}
+
+//-- Closes both an archive entry reader and the archive file it is read from
+type archiveEntryReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *archiveEntryReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if cerr := r.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func isArchive(filename string) bool {
+	filename = strings.ToLower(filename)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(filename, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+//-- Split a path such as pack.zip!/policies/HR.pdf into the archive and the entry within it
+func splitArchivePath(filePath string) (string, string, bool) {
+	i := strings.Index(filePath, archiveSeparator)
+	if i < 0 || !isArchive(filePath[:i]) {
+		return filePath, "", false
+	}
+	return filePath[:i], strings.TrimPrefix(filePath[i+len(archiveSeparator):], "/"), true
+}
+
+//-- An opened archive, kept open with its entries indexed so each entry can be read without rescanning it.
+//-- A compressed tar is decompressed once to a temporary file, so its entries can be read at their offsets
+type archiveIndexStruct struct {
+	zip     *zip.ReadCloser
+	file    *os.File
+	temp    string
+	names   []string
+	entries map[string]archiveEntryStruct
+}
+
+type archiveEntryStruct struct {
+	zipFile *zip.File
+	offset  int64
+	size    int64
+	modTime time.Time
+}
+
+var (
+	archiveIndexes = make(map[string]*archiveIndexStruct)
+	archiveMutex   sync.Mutex
+)
+
+//-- Open a file on disk, or an entry within an archive, returning a reader and its size
+func openSource(filePath string) (io.ReadCloser, int64, error) {
+	archivePath, entryName, inArchive := splitArchivePath(filePath)
+	if !inArchive {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return nil, 0, err
+		}
+		stats, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, stats.Size(), nil
+	}
+
+	entry, idx, err := archiveEntry(archivePath, entryName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry.zipFile != nil {
+		rc, err := entry.zipFile.Open()
+		if err != nil {
+			return nil, 0, err
+		}
+		return &archiveEntryReader{Reader: rc, closers: []io.Closer{rc}}, entry.size, nil
+	}
+	return &archiveEntryReader{Reader: io.NewSectionReader(idx.file, entry.offset, entry.size)}, entry.size, nil
+}
+
+//-- Size and modification time of a file on disk, or of an entry within an archive from its header
+func statSource(filePath string) (int64, time.Time, error) {
+	archivePath, entryName, inArchive := splitArchivePath(filePath)
+	if !inArchive {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		return info.Size(), info.ModTime(), nil
+	}
+	entry, _, err := archiveEntry(archivePath, entryName)
+	return entry.size, entry.modTime, err
+}
+
+func archiveEntry(archivePath, entryName string) (archiveEntryStruct, *archiveIndexStruct, error) {
+	idx, err := indexArchive(archivePath)
+	if err != nil {
+		return archiveEntryStruct{}, nil, err
+	}
+	entry, ok := idx.entries[entryName]
+	if !ok {
+		return entry, idx, errors.New("entry " + entryName + " not found in " + archivePath)
+	}
+	return entry, idx, nil
+}
+
+//-- Open and index an archive, once per run
+func indexArchive(archivePath string) (*archiveIndexStruct, error) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	if idx, ok := archiveIndexes[archivePath]; ok {
+		return idx, nil
+	}
+	idx := &archiveIndexStruct{entries: make(map[string]archiveEntryStruct)}
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		idx.zip = zr
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			idx.names = append(idx.names, f.Name)
+			idx.entries[f.Name] = archiveEntryStruct{zipFile: f, size: int64(f.UncompressedSize64), modTime: f.Modified}
+		}
+		archiveIndexes[archivePath] = idx
+		return idx, nil
+	}
+
+	err := openTar(idx, archivePath)
+	if err != nil {
+		idx.close()
+		return nil, err
+	}
+	//The tar reader reads headers a block at a time and seeks over entry data, so the file position after
+	//each header is where its data starts
+	tr := tar.NewReader(idx.file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			idx.close()
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		offset, err := idx.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			idx.close()
+			return nil, err
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		idx.names = append(idx.names, name)
+		idx.entries[name] = archiveEntryStruct{offset: offset, size: hdr.Size, modTime: hdr.ModTime}
+	}
+	archiveIndexes[archivePath] = idx
+	return idx, nil
+}
+
+//-- Open a tar for indexing, decompressing a .tar.gz or .tgz to a temporary file first
+func openTar(idx *archiveIndexStruct, archivePath string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	lower := strings.ToLower(archivePath)
+	if !strings.HasSuffix(lower, ".gz") && !strings.HasSuffix(lower, ".tgz") {
+		idx.file = f
+		return nil
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	temp, err := ioutil.TempFile("", logPrefix+"_archive_*.tar")
+	if err != nil {
+		return err
+	}
+	idx.file, idx.temp = temp, temp.Name()
+	logInfo("Decompressing "+archivePath+" to "+idx.temp, false)
+	_, err = io.Copy(temp, gz)
+	if err != nil {
+		return err
+	}
+	_, err = temp.Seek(0, io.SeekStart)
+	return err
+}
+
+func (idx *archiveIndexStruct) close() {
+	if idx.zip != nil {
+		idx.zip.Close()
+	}
+	if idx.file != nil {
+		idx.file.Close()
+	}
+	if idx.temp != "" {
+		os.Remove(idx.temp)
+	}
+}
+
+//-- Close the archives opened during the run, removing any decompressed copies
+func closeArchives() {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+	for archivePath, idx := range archiveIndexes {
+		idx.close()
+		delete(archiveIndexes, archivePath)
+	}
+}
+
+//-- List the regular file entries in an archive
+func listArchive(archivePath string) ([]string, error) {
+	idx, err := indexArchive(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return idx.names, nil
+}
+
+//-- Add the files within an archive, optionally below a folder given as archive!/folder, to the document list.
+//-- If the archive holds a docs_main.csv manifest at that folder then it is used in place of the crawled entries.
+func crawlArchive(root string) error {
+	archivePath, prefix, _ := splitArchivePath(root)
+	if !strings.Contains(root, archiveSeparator) {
+		archivePath = root
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	entries, err := listArchive(archivePath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		for _, manifest := range archiveManifests {
+			if entry == prefix+manifest.name && *manifest.flag == "" {
+				*manifest.flag = archivePath + archiveSeparator + entry
+				logInfo("Using manifest "+*manifest.flag, true)
+			}
+		}
+	}
+	if _, _, inArchive := splitArchivePath(flags.configCSVMain); inArchive {
+		return nil
+	}
+
+	manifests := make(map[string]bool)
+	for _, manifest := range archiveManifests {
+		manifests[prefix+manifest.name] = true
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, prefix) || manifests[entry] || (flags.configSidecars && isSidecar(entry)) {
+			continue
+		}
+		file := csvStruct{
+			Filepath: archivePath + archiveSeparator + entry,
+			Status:   flags.configCrawlStatus,
+		}
+		if flags.configSidecars {
+			applySidecars(&file)
+		}
+		csvContent = append(csvContent, file)
+	}
+	return nil
+}
+
+//-- When the main CSV is inside an archive, relative Filepaths in the CSVs refer to entries in that archive
+func setCSVPathBase(csvPath string) {
+	archivePath, entryName, inArchive := splitArchivePath(csvPath)
+	if !inArchive {
+		return
+	}
+	csvPathBase = archivePath + archiveSeparator
+	if dir := path.Dir(entryName); dir != "." {
+		csvPathBase += dir + "/"
+	}
+}
+
+//-- Resolve a Filepath from a CSV inside an archive to its location within that archive
+func resolveCSVPath(filePath string) string {
+	if csvPathBase == "" || strings.Contains(filePath, archiveSeparator) || path.IsAbs(filePath) || filepath.IsAbs(filePath) {
+		return filePath
+	}
+	return csvPathBase + strings.TrimPrefix(filePath, "./")
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestSplitArchivePath(t *testing.T) {
+	tests := []struct {
+		filePath  string
+		archive   string
+		entry     string
+		inArchive bool
+	}{
+		{"pack.zip!/policies/HR.pdf", "pack.zip", "policies/HR.pdf", true},
+		{"/data/Pack.ZIP!/HR.pdf", "/data/Pack.ZIP", "HR.pdf", true},
+		{"pack.tar.gz!//HR.pdf", "pack.tar.gz", "HR.pdf", true},
+		{"pack.tgz!/", "pack.tgz", "", true},
+		{"pack.zip!/inner.zip!/HR.pdf", "pack.zip", "inner.zip!/HR.pdf", true},
+		{"notes!/HR.pdf", "notes!/HR.pdf", "", false},
+		{"/data/HR.pdf", "/data/HR.pdf", "", false},
+		{"pack.zip", "pack.zip", "", false},
+	}
+	for _, tt := range tests {
+		archive, entry, inArchive := splitArchivePath(tt.filePath)
+		if archive != tt.archive || entry != tt.entry || inArchive != tt.inArchive {
+			t.Errorf("splitArchivePath(%q) = %q, %q, %v, want %q, %q, %v", tt.filePath,
+				archive, entry, inArchive, tt.archive, tt.entry, tt.inArchive)
+		}
+	}
+}
+
+func TestResolveCSVPath(t *testing.T) {
+	defer func(base string) { csvPathBase = base }(csvPathBase)
+	csvPathBase = ""
+	setCSVPathBase("pack.zip!/csv/docs_main.csv")
+	tests := []struct {
+		filePath string
+		want     string
+	}{
+		{"HR.pdf", "pack.zip!/csv/HR.pdf"},
+		{"./HR.pdf", "pack.zip!/csv/HR.pdf"},
+		{"other.zip!/HR.pdf", "other.zip!/HR.pdf"},
+		{"/data/HR.pdf", "/data/HR.pdf"},
+	}
+	for _, tt := range tests {
+		if got := resolveCSVPath(tt.filePath); got != tt.want {
+			t.Errorf("resolveCSVPath(%q) = %q, want %q", tt.filePath, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+//-- Tag linked to the probe document, to check the API key can create and link tags
+const checkTag = "Document Import Check"
+
+type xmlmcSessionInfoStruct struct {
+	UserID    string `xml:"params>userId"`
+	AccountID string `xml:"params>accountId"`
+}
+
+//-- A pre-flight check, with the exit code to use when it fails
+type checkStruct struct {
+	name     string
+	exitCode int
+	run      func() (string, error)
+}
+
+//-- Run the pre-flight checks, stopping at the first failure. For -mode migrate the source instance and its
+//-- API key are checked as well. With writes, a probe document is created, tagged, shared with the API key's
+//-- own user and deleted, along with the tag if the check created it, to check the key has the rights the
+//-- import needs.
+//-- Rights are not checked with -dryrun, as nothing would be created. Returns the exit code for the failed
+//-- check, or exitSuccess
+func runChecks(writes bool) int {
+	writes = writes && !flags.configDryRun
+	logInfo("Running pre-flight checks against "+flags.configInstanceID, true)
+	saved := counters
+	defer func() { counters = saved }()
+
+	userID := ""
+	createdTag := 0
+	probe := csvStruct{Title: "Document Import pre-flight check", Status: "archived", ContentType: "text/plain"}
+	checks := []checkStruct{
+		{"Instance endpoint", exitValidation, func() (string, error) {
+			return checkEndpoint(targetInstance())
+		}},
+		{"API key", exitAuth, func() (string, error) {
+			var err error
+			userID, err = checkAPIKey(targetInstance())
+			if err != nil {
+				return "", err
+			}
+			return "authenticated as " + userID, nil
+		}},
+	}
+	if flags.configMode == "migrate" {
+		checks = append(checks,
+			checkStruct{"Source instance endpoint", exitValidation, func() (string, error) {
+				return checkEndpoint(sourceInstance)
+			}},
+			checkStruct{"Source API key", exitAuth, func() (string, error) {
+				sourceUserID, err := checkAPIKey(sourceInstance)
+				if err != nil {
+					return "", err
+				}
+				return "authenticated as " + sourceUserID, nil
+			}},
+		)
+	}
+	checks = append(checks,
+		checkStruct{"Session upload", exitTotal, func() (string, error) {
+			f, err := ioutil.TempFile("", logPrefix+"_check_*.txt")
+			if err != nil {
+				return "", err
+			}
+			defer os.Remove(f.Name())
+			_, err = f.WriteString("Hornbill Document Import pre-flight check " + runID + "\n")
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return "", err
+			}
+			probe.Filepath = f.Name()
+			probe.Filename = filepath.Base(f.Name())
+			probe.SessionPath = "session/" + probe.Filename
+			err = putFileInSession(&probe)
+			if err != nil {
+				return "", err
+			}
+			if writes {
+				return probe.SessionPath + " uploaded", nil
+			}
+			err = deleteFileFromSession(&probe)
+			if err != nil {
+				return "", err
+			}
+			return probe.SessionPath + " uploaded and deleted", nil
+		}},
+	)
+	if writes {
+		checks = append(checks,
+			checkStruct{"Create document", exitTotal, func() (string, error) {
+				docID, err := documentAdd(&probe)
+				if err != nil {
+					deleteFileFromSession(&probe)
+					return "", err
+				}
+				return "probe document " + docID + " created", nil
+			}},
+			checkStruct{"Tag document", exitTotal, func() (string, error) {
+				tagExists, _, err := findTag(checkTag)
+				if err != nil {
+					return "", err
+				}
+				err = processTag(probe.DocumentID, checkTag)
+				if !tagExists {
+					createdTag = foundTags[tagKey(checkTag)]
+				}
+				return "linked tag " + checkTag, err
+			}},
+			checkStruct{"Share document", exitTotal, func() (string, error) {
+				urn := "urn:sys:user:" + userID
+				return "shared with " + urn, shareDocument(probe.DocumentID, sharesStruct{URN: urn, Read: true})
+			}},
+			checkStruct{"Clean up", exitTotal, func() (string, error) {
+				err := documentDelete(probe.DocumentID)
+				if err != nil {
+					return "", err
+				}
+				detail := "probe document " + probe.DocumentID + " deleted"
+				if createdTag != 0 {
+					err = deleteCheckTag(createdTag)
+					if err != nil {
+						return "", err
+					}
+					detail += ", tag " + checkTag + " deleted"
+				}
+				return detail, deleteFileFromSession(&probe)
+			}},
+		)
+	}
+
+	for i, check := range checks {
+		detail, err := check.run()
+		if err != nil {
+			logError("✘ "+check.name+": "+err.Error(), true)
+			if probe.DocumentID != "" && i < len(checks)-1 {
+				if delErr := documentDelete(probe.DocumentID); delErr != nil {
+					logError("Unable to delete probe document "+probe.DocumentID+": "+delErr.Error(), true)
+				}
+				deleteFileFromSession(&probe)
+			}
+			if createdTag != 0 && i < len(checks)-1 {
+				if delErr := deleteCheckTag(createdTag); delErr != nil {
+					logError("Unable to delete tag "+checkTag+": "+delErr.Error(), true)
+				}
+			}
+			if check.exitCode == exitTotal {
+				return failureExitCode(err)
+			}
+			return check.exitCode
+		}
+		logInfo("✔ "+check.name+": "+detail, true)
+	}
+	if !writes {
+		logInfo("Document, tag and share rights not checked, use -mode check or -checkwrites to check them", true)
+	}
+	logInfo("Pre-flight checks passed", true)
+	return exitSuccess
+}
+
+func checkEndpoint(inst instanceStruct) (string, error) {
+	if inst.xmlmc.FileError != nil {
+		return "", errors.New("unable to resolve instance " + inst.id + ": " + inst.xmlmc.FileError.Error())
+	}
+	if inst.xmlmc.GetServerURL() == "" {
+		return "", errors.New("no endpoint found for instance " + inst.id)
+	}
+	return inst.xmlmc.GetServerURL(), nil
+}
+
+//-- Make an authenticated call, returning the user the API key belongs to
+func checkAPIKey(inst instanceStruct) (string, error) {
+	var info xmlmcSessionInfoStruct
+	err := invokeXMLMCOn(inst.xmlmc, "session", "getSessionInfo", &info)
+	if err != nil {
+		return "", err
+	}
+	if info.UserID == "" {
+		return info.AccountID, nil
+	}
+	return info.UserID, nil
+}
+
+//-- Delete the check tag when the checks created it, so it is not left in the library
+func deleteCheckTag(tagID int) error {
+	delete(foundTags, tagKey(checkTag))
+	espXmlmc.SetParam("tagGroup", "urn:tagGroup:library")
+	espXmlmc.SetParam("tagId", strconv.Itoa(tagID))
+	return invokeXMLMC("library", "tagDelete", nil)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+//-- Timestamp layouts accepted in the comments CSV
+var commentTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"02/01/2006 15:04:05",
+	"02/01/2006 15:04",
+	"02/01/2006",
+}
+
+type commentStruct struct {
+	Author    string
+	Timestamp string
+	Time      time.Time
+	Text      string
+}
+
+func getCSVComments() error {
+	lines, err := readCSV(flags.configCSVComments)
+	if err != nil {
+		return err
+	}
+	lastTime := make(map[string]time.Time)
+	for _, line := range lines {
+		if strings.ToLower(line[0]) == "filepath" || line[0] == "" {
+			continue
+		}
+		comment := commentStruct{
+			Author:    strings.TrimSpace(line[1]),
+			Timestamp: strings.TrimSpace(line[2]),
+			Text:      line[3],
+		}
+		filePath := resolveCSVPath(line[0])
+		if comment.Timestamp == "" {
+			//Undated comments keep their place in the file, after the comment before them
+			comment.Time = lastTime[filePath]
+		} else {
+			comment.Time, err = parseCommentTime(comment.Timestamp)
+			if err != nil {
+				logError("Invalid comment timestamp "+comment.Timestamp+" for "+line[0], true)
+				addReport(filePath, "", "comment", "failed", "invalid timestamp "+comment.Timestamp)
+				continue
+			}
+			lastTime[filePath] = comment.Time
+		}
+		csvComments[filePath] = append(csvComments[filePath], comment)
+	}
+	for filePath := range csvComments {
+		comments := csvComments[filePath]
+		sort.SliceStable(comments, func(i, j int) bool {
+			return comments[i].Time.Before(comments[j].Time)
+		})
+	}
+	return nil
+}
+
+func parseCommentTime(timestamp string) (time.Time, error) {
+	var err error
+	for _, layout := range commentTimeLayouts {
+		var t time.Time
+		t, err = time.ParseInLocation(layout, timestamp, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+//-- Post the imported comments, oldest first, then the optional import note, to a document's activity stream
+func processComments(file *csvStruct) {
+	for _, comment := range csvComments[file.Filepath] {
+		content := comment.Text
+		switch {
+		case comment.Author != "" && comment.Timestamp != "":
+			content = "Originally posted by " + comment.Author + " on " + comment.Time.Format("2006-01-02 15:04") + ":\n\n" + comment.Text
+		case comment.Author != "":
+			content = "Originally posted by " + comment.Author + ":\n\n" + comment.Text
+		case comment.Timestamp != "":
+			content = "Originally posted on " + comment.Time.Format("2006-01-02 15:04") + ":\n\n" + comment.Text
+		}
+		err := postActivity(file.DocumentID, file.ActivityStreamID, content)
+		if err != nil {
+			counters.comments.addFailed++
+			logError(err.Error(), true)
+			addReport(file.Filepath, file.DocumentID, "comment", "failed", comment.Timestamp+": "+err.Error())
+		} else {
+			counters.comments.addSuccess++
+		}
+	}
+	if flags.configImportedFrom != "" {
+		err := postActivity(file.DocumentID, file.ActivityStreamID, "Imported from "+flags.configImportedFrom)
+		if err != nil {
+			counters.comments.addFailed++
+			logError(err.Error(), true)
+			addReport(file.Filepath, file.DocumentID, "comment", "failed", "import note: "+err.Error())
+		} else {
+			counters.comments.addSuccess++
+		}
+	}
+}
+
+func postActivity(documentID, activityStreamID, content string) error {
+	logInfo("Posting to Activity Stream of Document "+documentID, false)
+	espXmlmc.SetParam("activityStreamID", activityStreamID)
+	espXmlmc.SetParam("content", content)
+	espXmlmc.SetParam("visibility", "public")
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("activity", "postMessage", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Activity Posted Successfully", false)
+	} else {
+		logInfo("[DRYRUN] activity::postMessage:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+//-- Build the document list from the files found under a directory, instead of a main CSV
+func getCrawlDocuments(root string) error {
+	if archivePath, _, _ := splitArchivePath(root); isArchive(archivePath) {
+		return crawlArchive(root)
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logError("Error crawling "+path+": "+err.Error(), true)
+			addReport(path, "", "crawl", "failed", err.Error())
+			return nil
+		}
+		if info.IsDir() || (flags.configSidecars && isSidecar(path)) {
+			return nil
+		}
+		file := csvStruct{
+			Filepath: path,
+			Status:   flags.configCrawlStatus,
+		}
+		if flags.configSidecars {
+			applySidecars(&file)
+		}
+		csvContent = append(csvContent, file)
+		return nil
+	})
+}
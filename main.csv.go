@@ -2,23 +2,30 @@ package main
 
 import (
 	"encoding/csv"
-	"os"
 	"strconv"
 	"strings"
 )
 
-func getCSVDocuments() {
+func getCSVDocuments() error {
 	lines, err := readCSV(flags.configCSVMain)
 	if err != nil {
-		logError(err.Error(), true)
-		os.Exit(1)
+		return err
 	}
+	mimeTypeColumn := -1
+	var header []string
+	var customColumns []int
 	for _, line := range lines {
-		if strings.ToLower(line[0]) == "filepath" || line[0] == "" {
+		if strings.ToLower(line[0]) == "filepath" {
+			header = line
+			mimeTypeColumn = findColumn(line, "mimetype")
+			customColumns = getCustomColumns(line, mimeTypeColumn)
+			continue
+		}
+		if line[0] == "" {
 			continue
 		}
 		csvData := csvStruct{
-			Filepath:          line[0],
+			Filepath:          resolveCSVPath(line[0]),
 			Title:             line[1],
 			Status:            line[2],
 			Description:       line[3],
@@ -30,15 +37,31 @@ func getCSVDocuments() {
 		if err == nil {
 			csvData.VersioningEnabled = versioningEnabled
 		}
+		if mimeTypeColumn > -1 {
+			csvData.ContentType = strings.TrimSpace(line[mimeTypeColumn])
+		}
+		for _, i := range customColumns {
+			value := strings.TrimSpace(line[i])
+			if value == "" {
+				continue
+			}
+			field, err := checkFieldValue(header[i], value)
+			if err != nil {
+				logError(csvData.Filepath+": "+err.Error(), true)
+				addReport(csvData.Filepath, "", "fields", "failed", err.Error())
+				continue
+			}
+			csvData.CustomFields = append(csvData.CustomFields, field)
+		}
 		csvContent = append(csvContent, csvData)
 	}
+	return nil
 }
 
-func getCSVShares() {
+func getCSVShares() error {
 	lines, err := readCSV(flags.configCSVShares)
 	if err != nil {
-		logError(err.Error(), true)
-		os.Exit(1)
+		return err
 	}
 	for _, line := range lines {
 		if strings.ToLower(line[0]) == "filepath" || line[0] == "" {
@@ -62,15 +85,15 @@ func getCSVShares() {
 		if err == nil {
 			csvData.ModifyMetaData = modifyMetaData
 		}
-		csvShares[line[0]] = append(csvShares[line[0]], csvData)
+		csvShares[resolveCSVPath(line[0])] = append(csvShares[resolveCSVPath(line[0])], csvData)
 	}
+	return nil
 }
 
-func getCSVCollections() {
+func getCSVCollections() error {
 	lines, err := readCSV(flags.configCSVCollections)
 	if err != nil {
-		logError(err.Error(), true)
-		os.Exit(1)
+		return err
 	}
 	for _, line := range lines {
 		if strings.ToLower(line[0]) == "filepath" || line[0] == "" {
@@ -78,27 +101,38 @@ func getCSVCollections() {
 		}
 		collID, err := strconv.Atoi(line[1])
 		if err == nil {
-			csvCollections[line[0]] = append(csvCollections[line[0]], collID)
+			csvCollections[resolveCSVPath(line[0])] = append(csvCollections[resolveCSVPath(line[0])], collID)
 		}
 	}
+	return nil
 }
 
-func getCSVTags() {
+func getCSVTags() error {
 	lines, err := readCSV(flags.configCSVTags)
 	if err != nil {
-		logError(err.Error(), true)
-		os.Exit(1)
+		return err
 	}
 	for _, line := range lines {
 		if strings.ToLower(line[0]) == "filepath" || line[0] == "" {
 			continue
 		}
-		csvTags[line[0]] = append(csvTags[line[0]], line[1])
+		csvTags[resolveCSVPath(line[0])] = append(csvTags[resolveCSVPath(line[0])], line[1])
+	}
+	return nil
+}
+
+//-- Returns the index of the named column in a header row, or -1 if it is not present
+func findColumn(header []string, name string) int {
+	for i, column := range header {
+		if strings.EqualFold(strings.TrimSpace(column), name) {
+			return i
+		}
 	}
+	return -1
 }
 
 func readCSV(filename string) ([][]string, error) {
-	f, err := os.Open(filename)
+	f, _, err := openSource(filename)
 	if err != nil {
 		return [][]string{}, err
 	}
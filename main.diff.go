@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//-- Outcome of a diff, for the exit code
+var (
+	diffCompared int
+	diffsFound   bool
+)
+
+type diffReportStruct struct {
+	Matched    int             `json:"matched"`
+	Missing    []diffDocStruct `json:"missing"`
+	Extra      []diffDocStruct `json:"extra"`
+	Mismatched []diffDocStruct `json:"mismatched"`
+	Failed     []diffDocStruct `json:"failed"`
+}
+
+type diffDocStruct struct {
+	Filepath    string   `json:"filepath,omitempty"`
+	DocumentID  string   `json:"documentId,omitempty"`
+	Title       string   `json:"title"`
+	Differences []string `json:"differences,omitempty"`
+}
+
+//-- Compare the documents in the CSVs with those in the instance, without changing anything.
+//-- Documents are matched on the IDs in -previous when given, otherwise on title.
+func diffDocuments(previous map[string]idMapStruct) (diffReportStruct, error) {
+	var report diffReportStruct
+	docIDs, err := getLibraryDocumentIDs(targetInstance(), flags.configExportCollection, flags.configExportTag)
+	if err != nil {
+		return report, err
+	}
+	logInfo("Comparing "+strconv.Itoa(len(csvContent))+" files with "+strconv.Itoa(len(docIDs))+" documents in the instance", true)
+
+	instanceDocs := make(map[string]libraryDocStruct)
+	byTitle := make(map[string][]string)
+	failed := make(map[string]bool)
+	for _, docID := range docIDs {
+		doc, err := readLibraryDocument(targetInstance(), docID)
+		if err != nil {
+			logError("Error reading document "+docID+": "+err.Error(), true)
+			report.Failed = append(report.Failed, diffDocStruct{DocumentID: docID, Differences: []string{err.Error()}})
+			failed[docID] = true
+			continue
+		}
+		instanceDocs[docID] = doc
+		byTitle[doc.Title] = append(byTitle[doc.Title], docID)
+	}
+
+	matched := make(map[string]bool)
+	for _, file := range csvContent {
+		if rule := fileExcluded(file.Filepath); rule != "" {
+			continue
+		}
+		prepareFile(&file)
+		docID := ""
+		if prev, ok := previous[file.Filepath]; ok {
+			docID = prev.DocumentID
+		} else if ids := byTitle[file.Title]; len(ids) == 1 {
+			docID = ids[0]
+		} else if len(ids) > 1 {
+			report.Mismatched = append(report.Mismatched, diffDocStruct{
+				Filepath:    file.Filepath,
+				Title:       file.Title,
+				Differences: []string{"title matches " + strconv.Itoa(len(ids)) + " documents: " + strings.Join(ids, ", ")},
+			})
+			for _, id := range ids {
+				matched[id] = true
+			}
+			continue
+		}
+		if failed[docID] {
+			continue
+		}
+		doc, ok := instanceDocs[docID]
+		if !ok {
+			report.Missing = append(report.Missing, diffDocStruct{Filepath: file.Filepath, DocumentID: docID, Title: file.Title})
+			continue
+		}
+		matched[docID] = true
+		differences := diffDocument(&file, doc, previous[file.Filepath])
+		if len(differences) > 0 {
+			report.Mismatched = append(report.Mismatched, diffDocStruct{
+				Filepath:    file.Filepath,
+				DocumentID:  docID,
+				Title:       file.Title,
+				Differences: differences,
+			})
+		} else {
+			report.Matched++
+		}
+	}
+
+	for _, docID := range docIDs {
+		if !matched[docID] && !failed[docID] {
+			report.Extra = append(report.Extra, diffDocStruct{DocumentID: docID, Title: instanceDocs[docID].Title})
+		}
+	}
+	return report, nil
+}
+
+func diffDocument(file *csvStruct, doc libraryDocStruct, prev idMapStruct) []string {
+	var differences []string
+	for _, field := range []struct{ name, csv, instance string }{
+		{"title", file.Title, doc.Title},
+		{"description", file.Description, doc.Description},
+		{"status", file.Status, doc.Status},
+		{"reviewDate", file.ReviewDate, doc.ReviewDate},
+		{"owner", file.Owner, doc.Owner},
+	} {
+		if field.csv != "" && field.csv != field.instance {
+			differences = append(differences, field.name+": csv "+strconv.Quote(field.csv)+", instance "+strconv.Quote(field.instance))
+		}
+	}
+
+	missing, unexpected := diffTags(doc.Tags, csvTags[file.Filepath])
+	for _, tag := range missing {
+		differences = append(differences, "tag missing: "+tag)
+	}
+	for _, tag := range unexpected {
+		differences = append(differences, "tag unexpected: "+tag)
+	}
+	missing, unexpected = diffStrings(intsToStrings(doc.Collections), intsToStrings(csvCollections[file.Filepath]))
+	for _, coll := range missing {
+		differences = append(differences, "collection missing: "+coll)
+	}
+	for _, coll := range unexpected {
+		differences = append(differences, "collection unexpected: "+coll)
+	}
+	instanceShares := make(map[string]sharesStruct)
+	for _, share := range doc.Shares {
+		instanceShares[share.URN] = share
+	}
+	for _, share := range csvShares[file.Filepath] {
+		instanceShare, ok := instanceShares[share.URN]
+		delete(instanceShares, share.URN)
+		switch {
+		case !ok:
+			differences = append(differences, "share missing: "+share.URN)
+		case instanceShare != share:
+			differences = append(differences, "share permissions differ: "+share.URN)
+		}
+	}
+	var unexpectedShares []string
+	for urn := range instanceShares {
+		unexpectedShares = append(unexpectedShares, urn)
+	}
+	sort.Strings(unexpectedShares)
+	for _, urn := range unexpectedShares {
+		differences = append(differences, "share unexpected: "+urn)
+	}
+
+	//Content is compared with the hash recorded by a previous run, or with the instance copy when -diffcontent is set
+	hash, err := hashSource(file.Filepath)
+	if err != nil {
+		differences = append(differences, "content unreadable: "+err.Error())
+		return differences
+	}
+	if prev.Hash != "" && prev.Hash != hash {
+		differences = append(differences, "content checksum differs from previous run")
+	}
+	if flags.configDiffContent {
+		h := sha256.New()
+		err = downloadDocumentTo(targetInstance(), doc.DocumentID, h)
+		switch {
+		case err != nil:
+			differences = append(differences, "content download failed: "+err.Error())
+		case hex.EncodeToString(h.Sum(nil)) != hash:
+			differences = append(differences, "content checksum differs from instance")
+		}
+	}
+	return differences
+}
+
+//-- Log the differences, write them as JSON, and record them in the run report
+func outputDiff(report diffReportStruct) error {
+	for _, doc := range report.Missing {
+		logInfo("MISSING    "+doc.Filepath+" ("+doc.Title+")", true)
+		addReport(doc.Filepath, doc.DocumentID, "diff", "missing", doc.Title)
+	}
+	for _, doc := range report.Extra {
+		logInfo("EXTRA      "+doc.DocumentID+" ("+doc.Title+")", true)
+		addReport("", doc.DocumentID, "diff", "extra", doc.Title)
+	}
+	for _, doc := range report.Mismatched {
+		logInfo("MISMATCHED "+doc.Filepath+" ("+doc.DocumentID+")", true)
+		for _, difference := range doc.Differences {
+			logInfo("    "+difference, true)
+		}
+		addReport(doc.Filepath, doc.DocumentID, "diff", "mismatched", strings.Join(doc.Differences, "; "))
+	}
+	for _, doc := range report.Failed {
+		logInfo("FAILED     "+doc.DocumentID, true)
+		addReport("", doc.DocumentID, "diff", "failed", strings.Join(doc.Differences, "; "))
+	}
+	logInfo("🟢 Documents matching: "+strconv.Itoa(report.Matched), true)
+	logInfo("🔴 Documents missing from instance: "+strconv.Itoa(len(report.Missing)), true)
+	logInfo("🔴 Documents in instance but not in CSV: "+strconv.Itoa(len(report.Extra)), true)
+	logInfo("🔴 Documents with differences: "+strconv.Itoa(len(report.Mismatched)), true)
+	if len(report.Failed) > 0 {
+		logInfo("🔴 Documents that could not be read: "+strconv.Itoa(len(report.Failed)), true)
+	}
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(flags.configDiffReport, content, 0644)
+	if err != nil {
+		return err
+	}
+	logInfo("Differences written to "+flags.configDiffReport, true)
+	return nil
+}
+
+func (report diffReportStruct) hasDifferences() bool {
+	return len(report.Missing)+len(report.Extra)+len(report.Mismatched) > 0
+}
@@ -2,59 +2,111 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/xml"
-	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
 )
 
 func processDocuments() {
 	logInfo("Processing "+strconv.Itoa(len(csvContent))+" files", true)
-	for _, file := range csvContent {
+	progressStart(csvContent)
+	defer progressStop()
+	for i, file := range csvContent {
+		waitToContinue()
+		if stopRequested() {
+			logInfo("Stopping, "+strconv.Itoa(len(csvContent)-i)+" files not processed", true)
+			break
+		}
 		//Process filename and title
+		setLogDocument(i+1, file.Filepath)
+		progressFile(file.Filepath)
 		logInfo("Processing: "+file.Filepath, true)
-		file.Filename = filepath.Base(file.Filepath)
-		file.SessionPath = "session/" + file.Filename
-		if file.Title == "" {
-			file.Title = strings.Replace(file.Filename, filepath.Ext(file.Filename), "", 1)
+		if rule := fileExcluded(file.Filepath); rule != "" {
+			logInfo("Skipping: "+file.Filepath+" - "+rule, true)
+			addReport(file.Filepath, "", "filter", "skipped", rule)
+			counters.documents.skipped++
+			progressFileDone()
+			continue
 		}
+		prepareFile(&file)
 
 		//Add the file to the session
+		start := time.Now()
 		err := putFileInSession(&file)
+		recordTiming("session", start)
 		if err != nil {
 			logError(err.Error(), true)
+			addReport(file.Filepath, "", "session", "failed", err.Error())
 			counters.session.addFailed++
+			progressFileDone()
 			continue
 		}
 		counters.session.addSuccess++
 
 		//documentAdd API to create doc from session file
+		start = time.Now()
 		docID, err := documentAdd(&file)
+		recordTiming("document", start)
 		if err != nil {
 			logError(err.Error(), true)
+			addReport(file.Filepath, "", "document", "failed", err.Error())
 			counters.documents.addFailed++
 		} else {
 			counters.documents.addSuccess++
+			setLogDocumentID(docID)
+			addReport(file.Filepath, docID, "document", "success", file.Title)
+			importedDocs[file.Filepath] = docID
+			imported := newIDMapEntry(&file)
 			if file.Owner != "" {
+				start = time.Now()
 				err = documentSetOwner(docID, file.Owner)
+				recordTiming("owner", start)
+				if err != nil {
+					counters.owners.addFailed++
+					logError(err.Error(), true)
+					addReport(file.Filepath, docID, "owner", "failed", err.Error())
+					imported.Owner = ""
+				} else {
+					counters.owners.addSuccess++
+				}
+			}
+			var updateFields []customFieldStruct
+			for _, field := range file.CustomFields {
+				if field.On == "update" {
+					updateFields = append(updateFields, field)
+				}
+			}
+			if len(updateFields) > 0 {
+				err = documentUpdateFields(docID, updateFields)
 				if err != nil {
 					logError(err.Error(), true)
+					addReport(file.Filepath, docID, "fields", "failed", err.Error())
+					for _, field := range updateFields {
+						delete(imported.Fields, field.Field)
+					}
 				}
 			}
 			//Process Collections
 			if _, ok := csvCollections[file.Filepath]; ok {
 				for _, collectionID := range csvCollections[file.Filepath] {
+					start = time.Now()
 					err = addToCollection(file.DocumentID, collectionID)
+					recordTiming("collection", start)
 					if err != nil {
 						counters.collections.addFailed++
 						logError(err.Error(), true)
+						addReport(file.Filepath, file.DocumentID, "collection", "failed", strconv.Itoa(collectionID)+": "+err.Error())
 					} else {
 						counters.collections.addSuccess++
+						imported.Collections = append(imported.Collections, collectionID)
 					}
 				}
 			}
@@ -62,12 +114,16 @@ func processDocuments() {
 			//Process Shares
 			if _, ok := csvShares[file.Filepath]; ok {
 				for _, share := range csvShares[file.Filepath] {
+					start = time.Now()
 					err = shareDocument(file.DocumentID, share)
+					recordTiming("share", start)
 					if err != nil {
 						counters.shares.addFailed++
 						logError(err.Error(), true)
+						addReport(file.Filepath, file.DocumentID, "share", "failed", share.URN+": "+err.Error())
 					} else {
 						counters.shares.addSuccess++
+						imported.Shares = append(imported.Shares, share)
 					}
 				}
 			}
@@ -75,63 +131,110 @@ func processDocuments() {
 			//Process Tags
 			if _, ok := csvTags[file.Filepath]; ok {
 				for _, tag := range csvTags[file.Filepath] {
+					start = time.Now()
 					err = processTag(file.DocumentID, tag)
+					recordTiming("tag", start)
 					if err != nil {
 						counters.tags.addFailed++
 						logError(err.Error(), true)
+						addReport(file.Filepath, file.DocumentID, "tag", "failed", tag+": "+err.Error())
 					} else {
 						counters.tags.addSuccess++
+						imported.Tags = append(imported.Tags, tag)
 					}
 				}
 			}
+
+			//Process Activity Stream comments
+			start = time.Now()
+			processComments(&file)
+			recordTiming("comments", start)
+			if docID != "" {
+				setIDMap(file.Filepath, imported)
+			}
 		}
 
 		//Delete the processed file from the session
+		start = time.Now()
 		err = deleteFileFromSession(&file)
+		recordTiming("sessionDelete", start)
 		if err != nil {
 			logError(err.Error(), true)
+			addReport(file.Filepath, file.DocumentID, "session", "failed", "delete: "+err.Error())
 			counters.session.deleteFailed++
 		} else {
 			counters.session.deleteSuccess++
 		}
+		progressFileDone()
+	}
+	setLogDocument(0, "")
+}
+
+//-- Work out the filename, session path and any defaulted metadata for a file
+func prepareFile(file *csvStruct) {
+	file.Filename = filepath.Base(file.Filepath)
+	file.SessionPath = "session/" + file.Filename
+	if flags.configExtractMeta {
+		applyEmbeddedMetadata(file)
+	}
+	if file.Title == "" {
+		file.Title = strings.Replace(file.Filename, filepath.Ext(file.Filename), "", 1)
 	}
 }
 
 func putFileInSession(file *csvStruct) error {
 	logInfo("Uploading: "+file.Filepath, false)
-	//Get file content
-	fileContent, err := getFileContent(file.Filepath)
+	//Open file, or archive entry, for streaming
+	src, size, err := openSource(file.Filepath)
 	if err != nil {
 		return err
 	}
-
-	//Work out file content type
-	file.ContentType = http.DetectContentType(fileContent)
-	logDebug("Content Type: "+file.ContentType, false)
-	if err != nil {
-		return err
+	defer src.Close()
+	body := bufio.NewReaderSize(src, mimeSniffLen)
+
+	//Work out file content type, unless one was provided in the CSV
+	if file.ContentType == "" {
+		header, _ := body.Peek(mimeSniffLen)
+		ra, _ := src.(io.ReaderAt)
+		file.ContentType = detectContentType(file.Filename, header, ra, size)
 	}
+	logDebug("Content Type: "+file.ContentType, false)
 
 	//Work out destination
 	endpoint := espXmlmc.DavEndpoint + file.SessionPath
 	logDebug("Destination: "+endpoint, false)
 
 	//PUT file in to API Key users session
-	req, err := http.NewRequest("PUT", endpoint, bytes.NewReader(fileContent))
+	hash := sha256.New()
+	req, err := http.NewRequest("PUT", endpoint, rateLimitReader{io.TeeReader(body, hash)})
 	if err != nil {
 		return err
 	}
+	req.ContentLength = size
 	req.Header.Set("Content-Type", file.ContentType)
 	req.Header.Set("Authorization", "ESP-APIKEY "+flags.configAPIKey)
-	client := &http.Client{}
-	res, err := client.Do(req)
+	throttleWait()
+	start := time.Now()
+	res, err := davClient.Do(req)
 	if err != nil {
+		throttleRecord(err)
 		return err
 	}
-	defer res.Body.Close()
+	defer drainBody(res)
+	metricObserve("docimport_dav_upload_duration_seconds", time.Since(start))
 
 	if res.StatusCode != 200 {
-		return errors.New(res.Status)
+		err = &httpStatusError{status: res.StatusCode, message: res.Status}
+		throttleRecord(err)
+		return err
+	}
+	throttleRecord(nil)
+	trackSessionFile(file)
+	file.ContentHash = hex.EncodeToString(hash.Sum(nil))
+	if size > 0 {
+		metricAdd("docimport_dav_upload_bytes_total", float64(size))
+		counters.session.bytes += uint64(size)
+		progressBytes(size)
 	}
 	logInfo("Upload Success: "+endpoint, false)
 	return nil
@@ -148,16 +251,21 @@ func deleteFileFromSession(file *csvStruct) error {
 		return err
 	}
 	req.Header.Set("Authorization", "ESP-APIKEY "+flags.configAPIKey)
-	client := &http.Client{}
-	res, err := client.Do(req)
+	throttleWait()
+	res, err := davClient.Do(req)
 	if err != nil {
+		throttleRecord(err)
 		return err
 	}
-	defer res.Body.Close()
+	defer drainBody(res)
 
 	if res.StatusCode != 204 {
-		return errors.New(res.Status)
+		err = &httpStatusError{status: res.StatusCode, message: res.Status}
+		throttleRecord(err)
+		return err
 	}
+	throttleRecord(nil)
+	untrackSessionFile(file)
 	logInfo("Delete Success", false)
 	return nil
 }
@@ -176,6 +284,11 @@ func documentAdd(file *csvStruct) (string, error) {
 	if file.VersioningEnabled {
 		espXmlmc.SetParam("enableRevisionTracking", strconv.FormatBool(file.VersioningEnabled))
 	}
+	for _, field := range file.CustomFields {
+		if field.On == "create" {
+			espXmlmc.SetParam(field.Field, field.Value)
+		}
+	}
 	espXmlmc.OpenElement("serverFile")
 	espXmlmc.SetParam("fileName", file.Filename)
 	espXmlmc.SetParam("fileSource", "/"+file.SessionPath)
@@ -184,21 +297,11 @@ func documentAdd(file *csvStruct) (string, error) {
 
 	//-- Check for Dry Run
 	if !flags.configDryRun {
-		logDebug("[library::documentAdd] "+espXmlmc.GetParam(), false)
-		XMLResponse, err := espXmlmc.Invoke("library", "documentAdd")
-		if err != nil {
-			return docID, err
-		}
-		logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
 		var xmlmcResponse xmlmcResponseStruct
-
-		err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
+		err := invokeXMLMC("library", "documentAdd", &xmlmcResponse)
 		if err != nil {
 			return docID, err
 		}
-		if xmlmcResponse.MethodResult != "ok" {
-			return docID, errors.New(xmlmcResponse.State.ErrorRet)
-		}
 		file.DocumentID = xmlmcResponse.DocumentID
 		file.ActivityStreamID = xmlmcResponse.ActivityStreamID
 		logInfo("Document "+file.DocumentID+" Created Successfully", false)
@@ -216,21 +319,10 @@ func documentSetOwner(documentID, owner string) error {
 	espXmlmc.SetParam("reason", "Owner set during import process")
 	//-- Check for Dry Run
 	if !flags.configDryRun {
-		logDebug("[library::documentChangeOwner] "+espXmlmc.GetParam(), false)
-		XMLResponse, err := espXmlmc.Invoke("library", "documentChangeOwner")
-		logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
-		if err != nil {
-			return err
-		}
-
-		var xmlmcResponse xmlmcResponseStruct
-		err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
+		err := invokeXMLMC("library", "documentChangeOwner", nil)
 		if err != nil {
 			return err
 		}
-		if xmlmcResponse.MethodResult != "ok" {
-			return errors.New(xmlmcResponse.State.ErrorRet)
-		}
 		logInfo("Document Owner Set Successfully", false)
 	} else {
 		logInfo("[DRYRUN] library::documentChangeOwner:"+espXmlmc.GetParam(), false)
@@ -245,21 +337,10 @@ func addToCollection(documentID string, collectionID int) error {
 	espXmlmc.SetParam("documentId", documentID)
 	//-- Check for Dry Run
 	if !flags.configDryRun {
-		logDebug("[apps/com.hornbill.docmanager/Collection::addToCollection] "+espXmlmc.GetParam(), false)
-		XMLResponse, err := espXmlmc.Invoke("apps/com.hornbill.docmanager/Collection", "addToCollection")
-		if err != nil {
-			return err
-		}
-		logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
-
-		var xmlmcResponse xmlmcResponseStruct
-		err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
+		err := invokeXMLMC("apps/com.hornbill.docmanager/Collection", "addToCollection", nil)
 		if err != nil {
 			return err
 		}
-		if xmlmcResponse.MethodResult != "ok" {
-			return errors.New(xmlmcResponse.State.ErrorRet)
-		}
 		logInfo("Document Added to Collection Successfully", false)
 	} else {
 		logInfo("[DRYRUN] apps/com.hornbill.docmanager/Collection::addToCollection:"+espXmlmc.GetParam(), false)
@@ -279,21 +360,11 @@ func shareDocument(documentID string, shareDetails sharesStruct) error {
 	espXmlmc.CloseElement("permissions")
 	//-- Check for Dry Run
 	if !flags.configDryRun {
-		logDebug("[library::documentShare] "+espXmlmc.GetParam(), false)
-		XMLResponse, err := espXmlmc.Invoke("library", "documentShare")
-		if err != nil {
-			return err
-		}
-		logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
-
 		var xmlmcResponse xmlmcResponseStruct
-		err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
+		err := invokeXMLMC("library", "documentShare", &xmlmcResponse)
 		if err != nil {
 			return err
 		}
-		if xmlmcResponse.MethodResult != "ok" {
-			return errors.New(xmlmcResponse.State.ErrorRet)
-		}
 		logInfo("Document Shared Successfully: "+xmlmcResponse.HPKID, false)
 	} else {
 		logInfo("[DRYRUN] library::documentShare:"+espXmlmc.GetParam(), false)
@@ -313,6 +384,9 @@ func processTag(documentID, tag string) error {
 		if err != nil {
 			return err
 		}
+		counters.tags.created++
+	} else {
+		counters.tags.reused++
 	}
 	err = linkTag(documentID, tagID)
 	return err
@@ -322,47 +396,53 @@ func findTag(tag string) (bool, int, error) {
 	logInfo("Searching For Tag: "+tag, false)
 	tagID := 0
 	tagExists := false
-	if tagKey, ok := foundTags[tag]; ok {
-		logInfo("Tag Found In Cache: "+strconv.Itoa(tagKey), false)
-		return true, tagKey, nil
+	key := tagKey(tag)
+	if cachedID, ok := foundTags[key]; ok {
+		logInfo("Tag Found In Cache: "+strconv.Itoa(cachedID), false)
+		metricAdd("docimport_tag_cache_total", 1, "result", "hit")
+		return true, cachedID, nil
 	}
-	espXmlmc.SetParam("tagGroup", "urn:tagGroup:library")
+	//Looked up even after a prefetch, as a watch or serve may run long after other users have added tags
+	metricAdd("docimport_tag_cache_total", 1, "result", "miss")
+	//-- Check for Dry Run
+	if flags.configDryRun {
+		logInfo("[DRYRUN] library::tagGetList: nameFilter "+tag, false)
+		return tagExists, tagID, nil
+	}
+	tagExists, tagID, err := lookupTag(espXmlmc, tag)
+	if err != nil {
+		return tagExists, tagID, err
+	}
+	if tagExists {
+		logInfo("Tag Found: "+strconv.Itoa(tagID), false)
+		foundTags[key] = tagID
+	} else {
+		logInfo("Tag Not Found", false)
+	}
+	return tagExists, tagID, nil
+}
+
+//-- Search an instance for a tag, without the cache. Where several tags match, the oldest is used, as a
+//-- prefetch would
+func lookupTag(conn *apiLib.XmlmcInstStruct, tag string) (bool, int, error) {
+	conn.SetParam("tagGroup", "urn:tagGroup:library")
 	//Escape backslash in tag
 	tagregex := regexp.MustCompile(`\\`)
 	tagSearch := tagregex.ReplaceAllString(tag, "\\\\")
-	espXmlmc.SetParam("nameFilter", tagSearch)
-
-	//-- Check for Dry Run
-	if !flags.configDryRun {
-		logDebug("[library::tagGetList] "+espXmlmc.GetParam(), false)
-		XMLResponse, err := espXmlmc.Invoke("library", "tagGetList")
-		if err != nil {
-			return tagExists, tagID, err
-		}
-		logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
+	conn.SetParam("nameFilter", tagSearch)
 
-		var xmlmcResponse xmlmcResponseStruct
-		err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
-		if err != nil {
-			return tagExists, tagID, err
-		}
-		if xmlmcResponse.MethodResult != "ok" {
-			return tagExists, tagID, errors.New(xmlmcResponse.State.ErrorRet)
-		}
-		for _, v := range xmlmcResponse.TagsFound {
-			if strings.EqualFold(v.Name, tag) {
-				logInfo("Tag Found: "+strconv.Itoa(v.ID), false)
-				tagExists = true
-				tagID = v.ID
-				foundTags[tag] = v.ID
-			}
-		}
-		if !tagExists {
-			logInfo("Tag Not Found", false)
+	var xmlmcResponse xmlmcResponseStruct
+	err := invokeXMLMCOn(conn, "library", "tagGetList", &xmlmcResponse)
+	if err != nil {
+		return false, 0, err
+	}
+	key := tagKey(tag)
+	tagExists, tagID := false, 0
+	for _, v := range xmlmcResponse.TagsFound {
+		if tagKey(v.Name) == key && (!tagExists || v.ID < tagID) {
+			tagExists = true
+			tagID = v.ID
 		}
-	} else {
-		logInfo("[DRYRUN] library::tagGetList:"+espXmlmc.GetParam(), false)
-		espXmlmc.ClearParam()
 	}
 	return tagExists, tagID, nil
 }
@@ -377,23 +457,13 @@ func addTag(tag string) (int, error) {
 
 	//-- Check for Dry Run
 	if !flags.configDryRun {
-		logDebug("[library::tagCreate] "+espXmlmc.GetParam(), false)
-		XMLResponse, err := espXmlmc.Invoke("library", "tagCreate")
-		if err != nil {
-			return tagID, err
-		}
-		logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
-
 		var xmlmcResponse xmlmcResponseStruct
-		err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
+		err := invokeXMLMC("library", "tagCreate", &xmlmcResponse)
 		if err != nil {
 			return tagID, err
 		}
-		if xmlmcResponse.MethodResult != "ok" {
-			return tagID, errors.New(xmlmcResponse.State.ErrorRet)
-		}
 		tagID = xmlmcResponse.TagID
-		foundTags[tag] = tagID
+		foundTags[tagKey(tag)] = tagID
 		logInfo("Tag Created Successfully: "+strconv.Itoa(tagID), false)
 	} else {
 		logInfo("[DRYRUN] library::tagCreate:"+espXmlmc.GetParam(), false)
@@ -409,21 +479,10 @@ func linkTag(documentID string, tagID int) error {
 	espXmlmc.SetParam("objectRefUrn", "urn:lib:document:"+documentID)
 	//-- Check for Dry Run
 	if !flags.configDryRun {
-		logDebug("[library::tagLinkObject] "+espXmlmc.GetParam(), false)
-		XMLResponse, err := espXmlmc.Invoke("library", "tagLinkObject")
-		if err != nil {
-			return err
-		}
-		logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
-
-		var xmlmcResponse xmlmcResponseStruct
-		err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
+		err := invokeXMLMC("library", "tagLinkObject", nil)
 		if err != nil {
 			return err
 		}
-		if xmlmcResponse.MethodResult != "ok" {
-			return errors.New(xmlmcResponse.State.ErrorRet)
-		}
 		logInfo("Tag Linked Successfully", false)
 	} else {
 		logInfo("[DRYRUN] library::tagLinkObject:"+espXmlmc.GetParam(), false)
@@ -436,25 +495,3 @@ func flattenXML(source string) string {
 	re := regexp.MustCompile(`(\r?\n)|\t`)
 	return re.ReplaceAllString(source, "")
 }
-
-func getFileContent(filename string) ([]byte, error) {
-	file, err := os.Open(filename)
-
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	stats, statsErr := file.Stat()
-	if statsErr != nil {
-		return nil, statsErr
-	}
-
-	var size int64 = stats.Size()
-	bytes := make([]byte, size)
-
-	bufr := bufio.NewReader(file)
-	_, err = bufr.Read(bytes)
-
-	return bytes, err
-}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+//-- Exit codes
+const (
+	exitSuccess     = 0 // everything worked, or failures were within -failthreshold
+	exitPartial     = 1 // some documents or stages failed
+	exitValidation  = 2 // bad flags or unreadable input, the same exit code flag.Parse uses
+	exitDifferences = 3 // -mode diff found differences
+	exitTotal       = 4 // nothing succeeded
+	exitAuth        = 5 // nothing succeeded and the instance rejected the API key
+)
+
+var exitDescriptions = map[int]string{
+	exitSuccess:     "success",
+	exitPartial:     "partial failure",
+	exitValidation:  "validation error",
+	exitDifferences: "differences found",
+	exitTotal:       "total failure",
+	exitAuth:        "authentication failure",
+}
+
+//-- Number of failures that looked like the API key being rejected
+var authFailures int32
+
+func isAuthError(message string) bool {
+	message = strings.ToLower(message)
+	for _, pattern := range []string{"401", "unauthorized", "authentication", "api key", "apikey"} {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+//-- Exit code for an error that stopped the run
+func failureExitCode(err error) int {
+	if err != nil && isAuthError(err.Error()) {
+		return exitAuth
+	}
+	return exitTotal
+}
+
+//-- Work out the exit code of a completed run from the failures in its report
+func runExitCode(rows []reportStruct) (int, int) {
+	failures := 0
+	for _, row := range rows {
+		if row.Outcome == "failed" {
+			failures++
+		}
+	}
+	successes := counters.documents.addSuccess + counters.updates.changed + counters.updates.unchanged +
+		counters.updates.revisions + counters.updates.removed + counters.exports.success + uint64(diffCompared)
+	switch {
+	case failures <= flags.configFailThreshold:
+		return exitSuccess, failures
+	case successes > 0:
+		return exitPartial, failures
+	case atomic.LoadInt32(&authFailures) > 0:
+		return exitAuth, failures
+	default:
+		return exitTotal, failures
+	}
+}
+
+//-- Log the outcome of the run, write the JUnit summary and exit with the code for it
+func finishRun() {
+	rows, err := allReportRows()
+	if err != nil {
+		//Fall back to the rows still held, which leaves out those already flushed
+		logError("Error reading back report "+flags.configReport+": "+err.Error(), true)
+		rows = reportSince(0)
+	}
+	code, failures := runExitCode(rows)
+	//A watch is stopped by a signal as a matter of course, any other run stopped early is incomplete
+	stopped := shutdownRequested() && flags.configMode != "watch"
+	if stopped && code == exitSuccess {
+		code = exitPartial
+	}
+	if diffsFound && code == exitSuccess {
+		code = exitDifferences
+	}
+	if flags.configJUnit != "" {
+		err := writeJUnit(flags.configJUnit, rows)
+		if err != nil {
+			logError("Error writing JUnit summary "+flags.configJUnit+": "+err.Error(), true)
+		} else {
+			logInfo("JUnit summary written to "+flags.configJUnit, true)
+		}
+	}
+	writeMetricsFileOrLog()
+	result := "Result: " + exitDescriptions[code]
+	if stopped {
+		result += ", stopped early"
+	}
+	logInfo(result+", "+strconv.Itoa(failures)+" failures with -failthreshold "+
+		strconv.Itoa(flags.configFailThreshold)+", exit code "+strconv.Itoa(code), true)
+	if code != exitSuccess {
+		os.Exit(code)
+	}
+}
+
+type junitSuitesStruct struct {
+	XMLName xml.Name           `xml:"testsuites"`
+	Suites  []junitSuiteStruct `xml:"testsuite"`
+}
+
+type junitSuiteStruct struct {
+	Name     string            `xml:"name,attr"`
+	Tests    int               `xml:"tests,attr"`
+	Failures int               `xml:"failures,attr"`
+	Skipped  int               `xml:"skipped,attr"`
+	Cases    []junitCaseStruct `xml:"testcase"`
+}
+
+type junitCaseStruct struct {
+	ClassName string              `xml:"classname,attr"`
+	Name      string              `xml:"name,attr"`
+	Failure   *junitFailureStruct `xml:"failure,omitempty"`
+	Skipped   *junitSkippedStruct `xml:"skipped,omitempty"`
+}
+
+type junitFailureStruct struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkippedStruct struct {
+	Message string `xml:"message,attr"`
+}
+
+//-- Write the report as JUnit XML, with each document as a test case that fails when any of its stages failed
+func writeJUnit(filename string, rows []reportStruct) error {
+	suite := junitSuiteStruct{Name: logPrefix + "." + flags.configMode}
+	index := make(map[string]int)
+	var details [][]string
+	for _, row := range rows {
+		name := row.Filepath
+		if name == "" {
+			name = row.DocumentID
+		}
+		if name == "" {
+			name = row.Stage
+		}
+		i, ok := index[name]
+		if !ok {
+			i = len(suite.Cases)
+			index[name] = i
+			suite.Cases = append(suite.Cases, junitCaseStruct{ClassName: suite.Name, Name: name})
+			details = append(details, nil)
+		}
+		testCase := &suite.Cases[i]
+		switch row.Outcome {
+		case "failed":
+			if testCase.Failure == nil {
+				testCase.Failure = &junitFailureStruct{Message: row.Stage + ": " + row.Detail, Type: row.Stage}
+			}
+			details[i] = append(details[i], row.Stage+": "+row.Detail)
+		case "skipped":
+			testCase.Skipped = &junitSkippedStruct{Message: row.Detail}
+		}
+	}
+	for i := range suite.Cases {
+		if suite.Cases[i].Failure != nil {
+			suite.Cases[i].Failure.Text = strings.Join(details[i], "\n")
+			suite.Cases[i].Skipped = nil
+			suite.Failures++
+		} else if suite.Cases[i].Skipped != nil {
+			suite.Skipped++
+		}
+	}
+	suite.Tests = len(suite.Cases)
+
+	content, err := xml.MarshalIndent(junitSuitesStruct{Suites: []junitSuiteStruct{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append([]byte(xml.Header), content...), 0644)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//-- Number of records requested per page when listing from the instance
+const exportPageSize = 100
+
+//-- A document as held in the instance library, with its tags, collections and shares
+type libraryDocStruct struct {
+	DocumentID        string         `xml:"documentId"`
+	Title             string         `xml:"title"`
+	Description       string         `xml:"description"`
+	Status            string         `xml:"status"`
+	ReviewDate        string         `xml:"reviewDate"`
+	Owner             string         `xml:"owner"`
+	FileName          string         `xml:"fileName"`
+	MimeType          string         `xml:"mimeType"`
+	VersioningEnabled bool           `xml:"enableRevisionTracking"`
+	Tags              []string       `xml:"-"`
+	Collections       []int          `xml:"-"`
+	Shares            []sharesStruct `xml:"-"`
+}
+
+type xmlmcDocumentListStruct struct {
+	Documents []struct {
+		DocumentID string `xml:"documentId"`
+	} `xml:"params>document"`
+	Objects []string `xml:"params>objectRefUrn"`
+}
+
+type xmlmcDocumentInfoStruct struct {
+	Document libraryDocStruct `xml:"params"`
+}
+
+type xmlmcDocumentCollectionsStruct struct {
+	Collections []int `xml:"params>collectionId"`
+}
+
+type xmlmcDocumentSharesStruct struct {
+	Shares []struct {
+		URN            string `xml:"share"`
+		Read           bool   `xml:"permissions>read"`
+		ModifyContent  bool   `xml:"permissions>modifyContent"`
+		ModifyMetaData bool   `xml:"permissions>modifyMetaData"`
+	} `xml:"params>shares"`
+}
+
+//-- Write the library, or the documents in -exportcollection or with -exporttag, out as importer CSVs and files
+func exportDocuments(inst instanceStruct, dir string) error {
+	fileDir := filepath.Join(dir, "files")
+	err := os.MkdirAll(fileDir, 0755)
+	if err != nil {
+		return err
+	}
+	docIDs, err := getLibraryDocumentIDs(inst, flags.configExportCollection, flags.configExportTag)
+	if err != nil {
+		return err
+	}
+	logInfo("Exporting "+strconv.Itoa(len(docIDs))+" documents to "+dir, true)
+
+	mainRows := [][]string{{"Filepath", "Title", "Status", "Description", "ReviewDate", "VersioningEnabled", "Owner", "MimeType"}}
+	shareRows := [][]string{{"Filepath", "URN", "Read", "ModifyContent", "ModifyMetaData"}}
+	collectionRows := [][]string{{"Filepath", "Collection"}}
+	tagRows := [][]string{{"Filepath", "Tag"}}
+	for _, docID := range docIDs {
+		waitToContinue()
+		if stopRequested() {
+			logInfo("Stopping, remaining documents not exported", true)
+			break
+		}
+		logInfo("Exporting: "+docID, true)
+		doc, err := readLibraryDocument(inst, docID)
+		if err != nil {
+			counters.exports.failed++
+			logError(err.Error(), true)
+			addReport("", docID, "export", "failed", err.Error())
+			continue
+		}
+		//Paths in the CSVs are relative to the export directory, so the export can be moved
+		name := filepath.Base(doc.FileName)
+		relPath := "files/" + docID + "/" + name
+		filePath := filepath.Clean(dir) + string(filepath.Separator) + relPath
+		if strings.TrimSpace(doc.FileName) == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+			err = errors.New("unusable file name " + strconv.Quote(doc.FileName))
+		} else {
+			err = os.MkdirAll(filepath.Dir(filePath), 0755)
+		}
+		if err == nil {
+			err = downloadDocument(inst, docID, filePath)
+		}
+		if err != nil {
+			counters.exports.failed++
+			logError(err.Error(), true)
+			addReport(filePath, docID, "export", "failed", err.Error())
+			continue
+		}
+
+		mainRows = append(mainRows, []string{relPath, doc.Title, doc.Status, doc.Description, doc.ReviewDate,
+			strconv.FormatBool(doc.VersioningEnabled), doc.Owner, doc.MimeType})
+		for _, share := range doc.Shares {
+			shareRows = append(shareRows, []string{relPath, share.URN, strconv.FormatBool(share.Read),
+				strconv.FormatBool(share.ModifyContent), strconv.FormatBool(share.ModifyMetaData)})
+		}
+		for _, collectionID := range doc.Collections {
+			collectionRows = append(collectionRows, []string{relPath, strconv.Itoa(collectionID)})
+		}
+		for _, tag := range doc.Tags {
+			tagRows = append(tagRows, []string{relPath, tag})
+		}
+		counters.exports.success++
+		exportedDocs[filePath] = docID
+		addReport(filePath, docID, "export", "success", doc.Title)
+	}
+
+	for name, rows := range map[string][][]string{
+		"docs_main.csv":        mainRows,
+		"docs_shares.csv":      shareRows,
+		"docs_collections.csv": collectionRows,
+		"docs_tags.csv":        tagRows,
+	} {
+		err = writeCSV(filepath.Join(dir, name), rows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//-- List the IDs of the documents in a collection, linked to a tag, or in the whole library
+func getLibraryDocumentIDs(inst instanceStruct, collectionID int, tag string) ([]string, error) {
+	var docIDs []string
+	tagID := 0
+	if tag != "" {
+		tagExists, foundID, err := lookupTag(inst.xmlmc, tag)
+		if err != nil {
+			return nil, err
+		}
+		if !tagExists {
+			return nil, errors.New("tag not found: " + tag)
+		}
+		tagID = foundID
+	}
+	for rowStart := 0; ; rowStart += exportPageSize {
+		service, method := "library", "documentGetList"
+		switch {
+		case collectionID > 0:
+			service, method = "apps/com.hornbill.docmanager/Collection", "getCollectionDocuments"
+			inst.xmlmc.SetParam("collectionId", strconv.Itoa(collectionID))
+		case tagID > 0:
+			method = "tagGetLinkedObjects"
+			inst.xmlmc.SetParam("tagGroup", "urn:tagGroup:library")
+			inst.xmlmc.SetParam("tagId", strconv.Itoa(tagID))
+		}
+		inst.xmlmc.SetParam("rowStart", strconv.Itoa(rowStart))
+		inst.xmlmc.SetParam("limit", strconv.Itoa(exportPageSize))
+
+		var xmlmcResponse xmlmcDocumentListStruct
+		err := invokeXMLMCOn(inst.xmlmc, service, method, &xmlmcResponse)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range xmlmcResponse.Documents {
+			docIDs = append(docIDs, doc.DocumentID)
+		}
+		for _, urn := range xmlmcResponse.Objects {
+			if strings.HasPrefix(urn, "urn:lib:document:") {
+				docIDs = append(docIDs, strings.TrimPrefix(urn, "urn:lib:document:"))
+			}
+		}
+		if len(xmlmcResponse.Documents)+len(xmlmcResponse.Objects) < exportPageSize {
+			break
+		}
+	}
+	return docIDs, nil
+}
+
+//-- Read a document's metadata, tags, collections and shares from the instance
+func readLibraryDocument(inst instanceStruct, docID string) (libraryDocStruct, error) {
+	inst.xmlmc.SetParam("documentId", docID)
+	var info xmlmcDocumentInfoStruct
+	err := invokeXMLMCOn(inst.xmlmc, "library", "documentGetInfo", &info)
+	if err != nil {
+		return info.Document, err
+	}
+	doc := info.Document
+	doc.DocumentID = docID
+	doc.Owner = strings.TrimPrefix(doc.Owner, "urn:sys:user:")
+
+	inst.xmlmc.SetParam("tagGroup", "urn:tagGroup:library")
+	inst.xmlmc.SetParam("objectRefUrn", "urn:lib:document:"+docID)
+	var tags xmlmcResponseStruct
+	err = invokeXMLMCOn(inst.xmlmc, "library", "tagGetListForObject", &tags)
+	if err != nil {
+		return doc, err
+	}
+	for _, tag := range tags.TagsFound {
+		doc.Tags = append(doc.Tags, tag.Name)
+		if inst.xmlmc == espXmlmc {
+			foundTags[tagKey(tag.Name)] = tag.ID
+		}
+	}
+
+	inst.xmlmc.SetParam("documentId", docID)
+	var collections xmlmcDocumentCollectionsStruct
+	err = invokeXMLMCOn(inst.xmlmc, "apps/com.hornbill.docmanager/Collection", "getDocumentCollections", &collections)
+	if err != nil {
+		return doc, err
+	}
+	doc.Collections = collections.Collections
+
+	inst.xmlmc.SetParam("documentId", docID)
+	var shares xmlmcDocumentSharesStruct
+	err = invokeXMLMCOn(inst.xmlmc, "library", "documentGetShareList", &shares)
+	if err != nil {
+		return doc, err
+	}
+	for _, share := range shares.Shares {
+		doc.Shares = append(doc.Shares, sharesStruct{
+			URN:            share.URN,
+			Read:           share.Read,
+			ModifyContent:  share.ModifyContent,
+			ModifyMetaData: share.ModifyMetaData,
+		})
+	}
+	return doc, nil
+}
+
+//-- Download the current content of a library document over DAV to a file
+func downloadDocument(inst instanceStruct, docID, destination string) error {
+	f, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	err = downloadDocumentTo(inst, docID, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	logInfo("Download Success: "+destination, false)
+	return nil
+}
+
+func downloadDocumentTo(inst instanceStruct, docID string, w io.Writer) error {
+	endpoint := inst.xmlmc.DavEndpoint + "library/" + docID
+	logInfo("Downloading: "+endpoint, false)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "ESP-APIKEY "+inst.apiKey)
+	throttleWait()
+	res, err := davClient.Do(req)
+	if err != nil {
+		throttleRecord(err)
+		return err
+	}
+	defer drainBody(res)
+
+	if res.StatusCode != 200 {
+		err = &httpStatusError{status: res.StatusCode, message: res.Status}
+		throttleRecord(err)
+		return err
+	}
+	throttleRecord(nil)
+	_, err = io.Copy(w, rateLimitReader{res.Body})
+	return err
+}
+
+func writeCSV(filename string, rows [][]string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	err = w.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	return w.Error()
+}
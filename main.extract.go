@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"html"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+type embeddedMetaStruct struct {
+	Title       string
+	Description string
+	Author      string
+	Keywords    []string
+	Sources     map[string]string
+}
+
+type ooxmlCoreStruct struct {
+	Title       string `xml:"http://purl.org/dc/elements/1.1/ title"`
+	Subject     string `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	Description string `xml:"http://purl.org/dc/elements/1.1/ description"`
+	Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Keywords    string `xml:"http://schemas.openxmlformats.org/package/2006/metadata/core-properties keywords"`
+}
+
+type odfMetaStruct struct {
+	Title          string   `xml:"meta>title"`
+	Subject        string   `xml:"meta>subject"`
+	Description    string   `xml:"meta>description"`
+	InitialCreator string   `xml:"meta>initial-creator"`
+	Creator        string   `xml:"meta>creator"`
+	Keywords       []string `xml:"meta>keyword"`
+}
+
+//-- Largest PDF, or streamed archive entry, read for embedded metadata. Zip based files on disk are read
+//-- through their central directory whatever their size
+const extractMaxSize = 64 << 20
+
+var (
+	pdfInfoRef    = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	xmpPacket     = regexp.MustCompile(`(?s)<x:xmpmeta.*?</x:xmpmeta>`)
+	xmpAltOrSeq   = `(?s)<%s[^>]*>\s*<rdf:(?:Alt|Seq|Bag)[^>]*>(.*?)</rdf:(?:Alt|Seq|Bag)>`
+	xmpListItem   = regexp.MustCompile(`(?s)<rdf:li[^>]*>(.*?)</rdf:li>`)
+	keywordSplit  = regexp.MustCompile(`[,;]`)
+	xmpTitle      = regexp.MustCompile(strings.Replace(xmpAltOrSeq, "%s", "dc:title", 1))
+	xmpDesc       = regexp.MustCompile(strings.Replace(xmpAltOrSeq, "%s", "dc:description", 1))
+	xmpCreator    = regexp.MustCompile(strings.Replace(xmpAltOrSeq, "%s", "dc:creator", 1))
+	xmpSubject    = regexp.MustCompile(strings.Replace(xmpAltOrSeq, "%s", "dc:subject", 1))
+	xmpPDFKeyword = regexp.MustCompile(`(?s)pdf:Keywords(?:="([^"]*)"|>(.*?)</pdf:Keywords>)`)
+)
+
+//-- Fill blank Title and Description fields from the properties embedded in the document itself
+func applyEmbeddedMetadata(file *csvStruct) {
+	if file.Title != "" && file.Description != "" && !flags.configKeywordTags {
+		return
+	}
+	src, size, err := openSource(file.Filepath)
+	if err != nil {
+		//Leave the error to be reported at upload
+		return
+	}
+	defer src.Close()
+	header := make([]byte, 5)
+	n, _ := io.ReadFull(src, header)
+	header = header[:n]
+	isPDF := bytes.HasPrefix(header, []byte("%PDF-"))
+	if !isPDF && !bytes.HasPrefix(header, zipMagic) {
+		return
+	}
+	if isPDF && size > extractMaxSize {
+		logDebug("Embedded metadata not read from "+file.Filepath+", larger than "+strconv.Itoa(extractMaxSize>>20)+"MB", false)
+		return
+	}
+
+	//Archive entries can only be streamed, so are read in to memory when small enough
+	ra, ok := src.(io.ReaderAt)
+	if !ok {
+		if size > extractMaxSize {
+			return
+		}
+		rest, err := ioutil.ReadAll(src)
+		if err != nil {
+			return
+		}
+		content := append(header, rest...)
+		ra, size = bytes.NewReader(content), int64(len(content))
+	}
+
+	var meta embeddedMetaStruct
+	if isPDF {
+		content := make([]byte, size)
+		if _, err := ra.ReadAt(content, 0); err != nil && err != io.EOF {
+			return
+		}
+		meta = extractPDFMetadata(content)
+	} else {
+		meta = extractZipMetadata(ra, size)
+	}
+
+	var applied []string
+	if file.Title == "" && meta.Title != "" {
+		file.Title = meta.Title
+		applied = append(applied, "Title from "+meta.Sources["Title"])
+	}
+	if file.Description == "" && meta.Description != "" {
+		file.Description = meta.Description
+		applied = append(applied, "Description from "+meta.Sources["Description"])
+	}
+	if meta.Author != "" {
+		applied = append(applied, "Author "+meta.Author+" in "+meta.Sources["Author"])
+	}
+	if flags.configKeywordTags && len(meta.Keywords) > 0 {
+		csvTags[file.Filepath] = append(csvTags[file.Filepath], meta.Keywords...)
+		applied = append(applied, "Tags "+strings.Join(meta.Keywords, ",")+" from "+meta.Sources["Keywords"])
+	}
+	if len(applied) > 0 {
+		logInfo("Embedded metadata: "+strings.Join(applied, "; "), false)
+		addReport(file.Filepath, "", "metadata", "extracted", strings.Join(applied, "; "))
+	}
+}
+
+//-- Set a metadata field, recording where it came from, unless it already has a value
+func (meta *embeddedMetaStruct) set(field, value, source string) {
+	value = strings.TrimSpace(value)
+	if value == "" || meta.Sources[field] != "" {
+		return
+	}
+	switch field {
+	case "Title":
+		meta.Title = value
+	case "Description":
+		meta.Description = value
+	case "Author":
+		meta.Author = value
+	case "Keywords":
+		for _, keyword := range keywordSplit.Split(value, -1) {
+			if keyword = strings.TrimSpace(keyword); keyword != "" {
+				meta.Keywords = append(meta.Keywords, keyword)
+			}
+		}
+	}
+	meta.Sources[field] = source
+}
+
+//-- Read the PDF Info dictionary, then fall back to the XMP metadata packet for anything it did not hold
+func extractPDFMetadata(content []byte) embeddedMetaStruct {
+	meta := embeddedMetaStruct{Sources: make(map[string]string)}
+	if refs := pdfInfoRef.FindAllSubmatch(content, -1); len(refs) > 0 {
+		ref := refs[len(refs)-1]
+		//The byte before the object number must not be a digit, or "1 0 obj" would also find "21 0 obj". The
+		//last definition wins, as incremental updates append new ones
+		objDef := regexp.MustCompile(`(?:^|[^0-9])` + string(ref[1]) + `\s+` + string(ref[2]) + `\s+obj`)
+		if defs := objDef.FindAllIndex(content, -1); len(defs) > 0 {
+			info := content[defs[len(defs)-1][0]:]
+			if objEnd := bytes.Index(info, []byte("endobj")); objEnd > -1 {
+				info = info[:objEnd]
+			}
+			meta.set("Title", pdfDictString(info, "/Title"), "PDF Info")
+			meta.set("Description", pdfDictString(info, "/Subject"), "PDF Info")
+			meta.set("Author", pdfDictString(info, "/Author"), "PDF Info")
+			meta.set("Keywords", pdfDictString(info, "/Keywords"), "PDF Info")
+		}
+	}
+	if packet := xmpPacket.Find(content); packet != nil {
+		meta.set("Title", xmpFirst(xmpTitle, packet), "XMP")
+		meta.set("Description", xmpFirst(xmpDesc, packet), "XMP")
+		meta.set("Author", xmpFirst(xmpCreator, packet), "XMP")
+		if m := xmpPDFKeyword.FindSubmatch(packet); m != nil {
+			meta.set("Keywords", html.UnescapeString(string(m[1])+string(m[2])), "XMP")
+		}
+		if m := xmpSubject.FindSubmatch(packet); m != nil {
+			var subjects []string
+			for _, li := range xmpListItem.FindAllSubmatch(m[1], -1) {
+				subjects = append(subjects, html.UnescapeString(string(li[1])))
+			}
+			meta.set("Keywords", strings.Join(subjects, ","), "XMP")
+		}
+	}
+	return meta
+}
+
+func xmpFirst(re *regexp.Regexp, packet []byte) string {
+	m := re.FindSubmatch(packet)
+	if m == nil {
+		return ""
+	}
+	li := xmpListItem.FindSubmatch(m[1])
+	if li == nil {
+		return ""
+	}
+	return html.UnescapeString(string(li[1]))
+}
+
+//-- Read a literal or hex string value for a key in a PDF dictionary
+func pdfDictString(dict []byte, key string) string {
+	i := bytes.Index(dict, []byte(key))
+	if i < 0 {
+		return ""
+	}
+	value := bytes.TrimLeft(dict[i+len(key):], " \t\r\n")
+	if len(value) == 0 {
+		return ""
+	}
+	var raw []byte
+	switch value[0] {
+	case '(':
+		raw = pdfLiteralString(value[1:])
+	case '<':
+		end := bytes.IndexByte(value, '>')
+		if end < 0 {
+			return ""
+		}
+		hex := bytes.Map(func(r rune) rune {
+			if strings.ContainsRune(" \t\r\n", r) {
+				return -1
+			}
+			return r
+		}, value[1:end])
+		if len(hex)%2 == 1 {
+			hex = append(hex, '0')
+		}
+		for j := 0; j+1 < len(hex); j += 2 {
+			b, err := strconv.ParseUint(string(hex[j:j+2]), 16, 8)
+			if err != nil {
+				return ""
+			}
+			raw = append(raw, byte(b))
+		}
+	default:
+		return ""
+	}
+	return pdfTextString(raw)
+}
+
+//-- Unescape a PDF literal string, starting after its opening bracket
+func pdfLiteralString(value []byte) []byte {
+	var out []byte
+	depth := 0
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b':
+				out = append(out, '\b')
+			case 'f':
+				out = append(out, '\f')
+			case '\r', '\n':
+				//Line continuation
+			default:
+				if value[i] >= '0' && value[i] <= '7' {
+					end := i + 1
+					for end < len(value) && end < i+3 && value[end] >= '0' && value[end] <= '7' {
+						end++
+					}
+					n, _ := strconv.ParseUint(string(value[i:end]), 8, 8)
+					out = append(out, byte(n))
+					i = end - 1
+				} else {
+					out = append(out, value[i])
+				}
+			}
+		case c == '(':
+			depth++
+			out = append(out, c)
+		case c == ')':
+			if depth == 0 {
+				return out
+			}
+			depth--
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+//-- PDF text strings are UTF-16BE when they start with a byte order mark, otherwise treated as Latin-1
+func pdfTextString(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		var units []uint16
+		for i := 2; i+1 < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+//-- Read OOXML docProps/core.xml or ODF meta.xml from a zip container
+func extractZipMetadata(ra io.ReaderAt, size int64) embeddedMetaStruct {
+	meta := embeddedMetaStruct{Sources: make(map[string]string)}
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return meta
+	}
+	for _, f := range zr.File {
+		switch f.Name {
+		case "docProps/core.xml":
+			entry, err := readZipEntry(f)
+			if err != nil {
+				continue
+			}
+			var core ooxmlCoreStruct
+			if xml.Unmarshal(entry, &core) != nil {
+				continue
+			}
+			meta.set("Title", core.Title, f.Name)
+			meta.set("Description", core.Description, f.Name)
+			meta.set("Description", core.Subject, f.Name)
+			meta.set("Author", core.Creator, f.Name)
+			meta.set("Keywords", core.Keywords, f.Name)
+		case "meta.xml":
+			entry, err := readZipEntry(f)
+			if err != nil {
+				continue
+			}
+			var odf odfMetaStruct
+			if xml.Unmarshal(entry, &odf) != nil {
+				continue
+			}
+			meta.set("Title", odf.Title, f.Name)
+			meta.set("Description", odf.Description, f.Name)
+			meta.set("Description", odf.Subject, f.Name)
+			meta.set("Author", odf.InitialCreator, f.Name)
+			meta.set("Author", odf.Creator, f.Name)
+			meta.set("Keywords", strings.Join(odf.Keywords, ","), f.Name)
+		}
+	}
+	return meta
+}
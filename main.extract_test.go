@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtractPDFMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		title       string
+		description string
+		author      string
+		keywords    []string
+	}{
+		{
+			name: "info dictionary",
+			content: "%PDF-1.4\n1 0 obj\n<< /Title (Leave Policy) /Subject (Annual leave) /Author (HR Team) " +
+				"/Keywords (hr, leave; policy) >>\nendobj\ntrailer\n<< /Root 2 0 R /Info 1 0 R >>\n%%EOF\n",
+			title:       "Leave Policy",
+			description: "Annual leave",
+			author:      "HR Team",
+			keywords:    []string{"hr", "leave", "policy"},
+		},
+		{
+			name: "higher object number ending in the same digits",
+			content: "%PDF-1.4\n1 0 obj\n<< /Title (Right) >>\nendobj\n21 0 obj\n<< /Title (Wrong) >>\nendobj\n" +
+				"41 0 obj\n<< /Title (Wrong too) >>\nendobj\ntrailer\n<< /Info 1 0 R >>\n%%EOF\n",
+			title: "Right",
+		},
+		{
+			name: "incremental update",
+			content: "%PDF-1.4\n3 0 obj\n<< /Title (Draft) >>\nendobj\ntrailer\n<< /Info 3 0 R >>\n%%EOF\n" +
+				"3 0 obj\n<< /Title (Final) >>\nendobj\ntrailer\n<< /Prev 9 /Info 3 0 R >>\n%%EOF\n",
+			title: "Final",
+		},
+		{
+			name:    "escapes and a UTF-16 hex string",
+			content: "1 0 obj<</Title (Policy \\(v2\\)\\051)/Author <FEFF00C9006C00E9>>>endobj trailer<</Info 1 0 R>>",
+			title:   "Policy (v2))",
+			author:  "Élé",
+		},
+		{
+			name: "XMP for what the info dictionary does not hold",
+			content: "1 0 obj<</Title (From Info)>>endobj\n<x:xmpmeta><dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">" +
+				"From XMP</rdf:li></rdf:Alt></dc:title><dc:creator><rdf:Seq><rdf:li>Amy &amp; Bob</rdf:li></rdf:Seq>" +
+				"</dc:creator></x:xmpmeta>\ntrailer<</Info 1 0 R>>",
+			title:  "From Info",
+			author: "Amy & Bob",
+		},
+		{
+			name:    "info object missing",
+			content: "trailer<</Info 7 0 R>> 17 0 obj<</Title (Wrong)>>endobj",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := extractPDFMetadata([]byte(tt.content))
+			if meta.Title != tt.title || meta.Description != tt.description || meta.Author != tt.author {
+				t.Errorf("extractPDFMetadata() = %q, %q, %q, want %q, %q, %q", meta.Title, meta.Description,
+					meta.Author, tt.title, tt.description, tt.author)
+			}
+			if !reflect.DeepEqual(meta.Keywords, tt.keywords) {
+				t.Errorf("extractPDFMetadata() keywords = %q, want %q", meta.Keywords, tt.keywords)
+			}
+		})
+	}
+}
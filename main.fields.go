@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-- Number of fixed columns at the start of the main CSV, any others are custom field columns
+const mainCSVColumns = 7
+
+var fieldSchema = make(map[string]fieldSchemaStruct)
+
+//-- Declares how an extra main CSV column is sent to Hornbill
+type fieldSchemaStruct struct {
+	Field string `json:"field"`
+	Type  string `json:"type"`
+	On    string `json:"on"`
+}
+
+type customFieldStruct struct {
+	Field string
+	Value string
+	On    string
+}
+
+//-- Load the custom field schema from a JSON file, keyed on CSV column name
+func loadFieldSchema(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	schema := make(map[string]fieldSchemaStruct)
+	err = json.Unmarshal(content, &schema)
+	if err != nil {
+		return err
+	}
+	for column, field := range schema {
+		if field.Field == "" {
+			return errors.New("no field given for column " + column)
+		}
+		switch field.Type {
+		case "":
+			field.Type = "string"
+		case "string", "int", "number", "bool", "date", "datetime":
+		default:
+			return errors.New("unknown type " + field.Type + " for column " + column)
+		}
+		switch field.On {
+		case "":
+			field.On = "create"
+		case "create", "update":
+		default:
+			return errors.New("unknown value " + field.On + " for on, for column " + column + ", expected create or update")
+		}
+		fieldSchema[strings.ToLower(column)] = field
+	}
+	return nil
+}
+
+//-- Returns the indexes of the custom field columns in the main CSV header, reporting any not in the schema
+func getCustomColumns(header []string, skip int) []int {
+	var columns []int
+	for i := mainCSVColumns; i < len(header); i++ {
+		column := strings.TrimSpace(header[i])
+		if i == skip || column == "" {
+			continue
+		}
+		if _, ok := fieldSchema[strings.ToLower(column)]; !ok {
+			logError("Column "+column+" in "+flags.configCSVMain+" is not mapped in -fieldschema, and will be ignored", true)
+			addReport(flags.configCSVMain, "", "fields", "unmapped", column)
+			continue
+		}
+		columns = append(columns, i)
+	}
+	return columns
+}
+
+//-- Check a custom field value against its declared type, returning the value as it should be sent
+func checkFieldValue(column, value string) (customFieldStruct, error) {
+	schema := fieldSchema[strings.ToLower(column)]
+	field := customFieldStruct{Field: schema.Field, Value: value, On: schema.On}
+	var err error
+	switch schema.Type {
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "number":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		field.Value = strconv.FormatBool(b)
+	case "date":
+		_, err = time.Parse("2006-01-02", value)
+	case "datetime":
+		_, err = time.Parse("2006-01-02 15:04:05", value)
+	}
+	if err != nil {
+		return field, errors.New("column " + column + " value " + value + " is not a valid " + schema.Type)
+	}
+	return field, nil
+}
+
+//-- Send the custom fields that could not be set by documentAdd
+func documentUpdateFields(documentID string, fields []customFieldStruct) error {
+	logInfo("Updating custom fields against Document "+documentID, false)
+	espXmlmc.SetParam("documentId", documentID)
+	for _, field := range fields {
+		espXmlmc.SetParam(field.Field, field.Value)
+	}
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("library", "documentUpdate", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Document Custom Fields Updated Successfully", false)
+	} else {
+		logInfo("[DRYRUN] library::documentUpdate:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
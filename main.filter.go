@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var fileFilters filterStruct
+
+type filterStruct struct {
+	includeExt     map[string]bool
+	excludeExt     map[string]bool
+	minSize        int64
+	maxSize        int64
+	modifiedAfter  time.Time
+	modifiedBefore time.Time
+	includeRegex   *regexp.Regexp
+	excludeRegex   *regexp.Regexp
+}
+
+//-- Build the file filters from the input flags
+func loadFilters() error {
+	var err error
+	fileFilters.includeExt = parseExtList(flags.configIncludeExt)
+	fileFilters.excludeExt = parseExtList(flags.configExcludeExt)
+	if fileFilters.minSize, err = parseSize(flags.configMinSize); err != nil {
+		return errors.New("invalid -minsize: " + err.Error())
+	}
+	if fileFilters.maxSize, err = parseSize(flags.configMaxSize); err != nil {
+		return errors.New("invalid -maxsize: " + err.Error())
+	}
+	if flags.configModifiedAfter != "" {
+		if fileFilters.modifiedAfter, err = time.ParseInLocation("2006-01-02", flags.configModifiedAfter, time.Local); err != nil {
+			return errors.New("invalid -modifiedafter: " + err.Error())
+		}
+	}
+	if flags.configModifiedBefore != "" {
+		if fileFilters.modifiedBefore, err = time.ParseInLocation("2006-01-02", flags.configModifiedBefore, time.Local); err != nil {
+			return errors.New("invalid -modifiedbefore: " + err.Error())
+		}
+	}
+	if flags.configIncludeRegex != "" {
+		if fileFilters.includeRegex, err = regexp.Compile(flags.configIncludeRegex); err != nil {
+			return errors.New("invalid -includeregex: " + err.Error())
+		}
+	}
+	if flags.configExcludeRegex != "" {
+		if fileFilters.excludeRegex, err = regexp.Compile(flags.configExcludeRegex); err != nil {
+			return errors.New("invalid -excluderegex: " + err.Error())
+		}
+	}
+	return nil
+}
+
+//-- Returns a description of the filter rule that excludes the file, or an empty string if it should be imported
+func fileExcluded(path string) string {
+	filename := filepath.Base(path)
+	ext := strings.ToLower(filepath.Ext(filename))
+	if len(fileFilters.includeExt) > 0 && !fileFilters.includeExt[ext] {
+		return "extension " + ext + " not in -includeext"
+	}
+	if fileFilters.excludeExt[ext] {
+		return "extension " + ext + " in -excludeext"
+	}
+	if fileFilters.includeRegex != nil && !fileFilters.includeRegex.MatchString(filename) {
+		return "filename does not match -includeregex"
+	}
+	if fileFilters.excludeRegex != nil && fileFilters.excludeRegex.MatchString(filename) {
+		return "filename matches -excluderegex"
+	}
+
+	if fileFilters.minSize == 0 && fileFilters.maxSize == 0 &&
+		fileFilters.modifiedAfter.IsZero() && fileFilters.modifiedBefore.IsZero() {
+		return ""
+	}
+	size, modTime, err := statSource(path)
+	if err != nil {
+		//Leave missing files to fail, and be reported, at upload
+		return ""
+	}
+	if fileFilters.minSize > 0 && size < fileFilters.minSize {
+		return "size " + strconv.FormatInt(size, 10) + " below -minsize"
+	}
+	if fileFilters.maxSize > 0 && size > fileFilters.maxSize {
+		return "size " + strconv.FormatInt(size, 10) + " above -maxsize"
+	}
+	if !fileFilters.modifiedAfter.IsZero() && modTime.Before(fileFilters.modifiedAfter) {
+		return "modified " + modTime.Format("2006-01-02") + " before -modifiedafter"
+	}
+	if !fileFilters.modifiedBefore.IsZero() && !modTime.Before(fileFilters.modifiedBefore) {
+		return "modified " + modTime.Format("2006-01-02") + " not before -modifiedbefore"
+	}
+	return ""
+}
+
+func parseExtList(list string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[ext] = true
+	}
+	return exts
+}
+
+//-- Parse a size in bytes, with an optional KB, MB or GB suffix
+func parseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(size, unit.suffix) {
+			multiplier = unit.multiplier
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"100", 100, false},
+		{"100B", 100, false},
+		{"10KB", 10 << 10, false},
+		{" 5 mb ", 5 << 20, false},
+		{"2GB", 2 << 30, false},
+		{"1.5MB", 0, true},
+		{"MB", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSize(%q) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestParseExtList(t *testing.T) {
+	got := parseExtList(" PDF, .docx,,txt ")
+	for _, ext := range []string{".pdf", ".docx", ".txt"} {
+		if !got[ext] {
+			t.Errorf("parseExtList() is missing %s", ext)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("parseExtList() = %v, want 3 extensions", got)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	apiLib "github.com/hornbill/goApiLib"
@@ -10,28 +12,46 @@ import (
 	easy "github.com/t-tomalak/logrus-easy-formatter"
 )
 
-func init() {
-	//Setup logging
-	cwd, _ := os.Getwd()
-	logPath := cwd + "/log"
+//-- Setup logging to -logdir, in the -logformat and at the -loglevel given
+func setupLogging() {
+	logPath = flags.configLogDir
+	if logPath == "" {
+		cwd, _ := os.Getwd()
+		logPath = cwd + "/log"
+	}
 	//-- If Folder Does Not Exist then create it
 	if _, err := os.Stat(logPath); os.IsNotExist(err) {
-		err := os.Mkdir(logPath, 0777)
+		err := os.MkdirAll(logPath, 0777)
 		if err != nil {
 			fmt.Println("Error Creating Log Folder ", logPath, ": ", err)
-			os.Exit(101)
+			os.Exit(exitValidation)
 		}
 	}
-	logFileName := logPath + "/" + logPrefix + "_" + time.Now().Format("20060102150405") + ".log"
-	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE, 0755)
+	logFileName := flags.configLogFile
+	if logFileName == "" {
+		logFileName = logPrefix + "_" + runTime + ".log"
+	}
+	if !filepath.IsAbs(logFileName) {
+		logFileName = logPath + "/" + logFileName
+	}
+	f, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
+	if err != nil {
+		fmt.Println("Error Opening Log File ", logFileName, ": ", err)
+		os.Exit(exitValidation)
+	}
+	level, err := logrus.ParseLevel(flags.configLogLevel)
 	if err != nil {
-		os.Exit(1)
+		fmt.Println("Unknown -loglevel: ", flags.configLogLevel)
+		os.Exit(exitValidation)
+	}
+	if flags.configDebug {
+		level = logrus.DebugLevel
 	}
 
 	//Setup logrus to FILE ONLY
 	logFile = &logrus.Logger{
 		Out:   f,
-		Level: logrus.DebugLevel,
+		Level: level,
 		Formatter: &easy.Formatter{
 			TimestampFormat: "2006-01-02 15:04:05",
 			LogFormat:       "%time% [%lvl%] %msg%\n",
@@ -44,6 +64,18 @@ func init() {
 		DisableTimestamp: true,
 	})
 	logStdOut.SetOutput(os.Stdout)
+	logStdOut.SetLevel(level)
+
+	switch flags.configLogFormat {
+	case "text":
+	case "json":
+		logJSON = true
+		logFile.Formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339}
+		logStdOut.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339})
+	default:
+		fmt.Println("Unknown -logformat: ", flags.configLogFormat)
+		os.Exit(exitValidation)
+	}
 }
 
 func main() {
@@ -56,29 +88,224 @@ func main() {
 		return
 	}
 
+	//Load MIME type overrides
+	if flags.configMimeMap != "" {
+		err := loadMimeOverrides(flags.configMimeMap)
+		if err != nil {
+			logError("Error loading MIME type map "+flags.configMimeMap+": "+err.Error(), true)
+			os.Exit(exitValidation)
+		}
+	}
+
+	//Load custom field schema
+	if flags.configFieldSchema != "" {
+		err := loadFieldSchema(flags.configFieldSchema)
+		if err != nil {
+			logError("Error loading field schema "+flags.configFieldSchema+": "+err.Error(), true)
+			os.Exit(exitValidation)
+		}
+	}
+
+	//Load sidecar property mapping
+	if flags.configSidecarMap != "" {
+		err := loadSidecarMapping(flags.configSidecarMap)
+		if err != nil {
+			logError("Error loading sidecar map "+flags.configSidecarMap+": "+err.Error(), true)
+			os.Exit(exitValidation)
+		}
+	}
+
+	//Load watched folder defaults
+	if flags.configWatchDefaults != "" {
+		err := loadWatchDefaults(flags.configWatchDefaults)
+		if err != nil {
+			logError("Error loading watch defaults "+flags.configWatchDefaults+": "+err.Error(), true)
+			os.Exit(exitValidation)
+		}
+	}
+
+	//Proxy and TLS settings, before the first connection to the instance
+	err := setupProxy()
+	if err == nil {
+		err = setupDavClient()
+	}
+	if err != nil {
+		logError("Error setting up connections: "+err.Error(), true)
+		os.Exit(exitValidation)
+	}
+
+	//Rate limits and -window
+	err = loadRateLimits()
+	if err != nil {
+		logError(err.Error(), true)
+		os.Exit(exitValidation)
+	}
+
 	//Hornbill Session
 	espXmlmc = apiLib.NewXmlmcInstance(flags.configInstanceID)
 	espXmlmc.SetAPIKey(flags.configAPIKey)
 	espXmlmc.SetTimeout(flags.configAPITimeout)
+	if flags.configMode == "migrate" {
+		sourceInstance = newInstance(flags.configSourceInstanceID, flags.configSourceAPIKey)
+	}
+
+	//Metrics endpoint
+	if flags.configMetricsListen != "" {
+		serveMetrics()
+	}
+
+	//Stop gracefully on SIGINT and SIGTERM, pause and resume on SIGUSR1 and SIGUSR2 or -controlfile
+	handleSignals()
 
-	//Grab CSV Data
-	getCSVDocuments()
-	if len(csvContent) > 0 {
-		if flags.configCSVShares != "" {
-			getCSVShares()
+	//Pre-flight checks, before any documents are touched. The probe document that checks the document,
+	//tag and share rights is only created by -mode check, or with -checkwrites in a mode that writes
+	if flags.configMode == "check" {
+		code := runChecks(true)
+		writeMetricsFileOrLog()
+		os.Exit(code)
+	}
+	if !flags.configSkipCheck {
+		code := runChecks(flags.configCheckWrites && flags.configMode != "export" && flags.configMode != "diff")
+		if code != exitSuccess {
+			logError("Pre-flight checks failed, nothing has been processed. Use -skipcheck to run without them", true)
+			os.Exit(code)
 		}
-		if flags.configCSVCollections != "" {
-			getCSVCollections()
+	}
+
+	//Build file filters
+	err = loadFilters()
+	if err != nil {
+		logError(err.Error(), true)
+		os.Exit(exitValidation)
+	}
+
+	//Load every library tag up front. A migration loads them once its export from the source instance is done
+	if flags.configTagPrefetch && flags.configMode != "migrate" {
+		err = prefetchTags()
+		if err != nil {
+			logError("Error loading library tags: "+err.Error(), true)
+			os.Exit(failureExitCode(err))
 		}
-		if flags.configCSVTags != "" {
-			getCSVTags()
+	}
+
+	switch flags.configMode {
+	case "diff":
+		runDiff()
+		return
+	case "export":
+		err = exportDocuments(targetInstance(), flags.configExportDir)
+		if err != nil {
+			logError("Error exporting to "+flags.configExportDir+": "+err.Error(), true)
+			os.Exit(failureExitCode(err))
+		}
+	case "migrate":
+		err = migrateDocuments()
+		if err != nil {
+			logError("Error migrating from "+flags.configSourceInstanceID+": "+err.Error(), true)
+			os.Exit(failureExitCode(err))
+		}
+	case "sync":
+		mustLoadDocuments()
+		err = syncDocuments()
+		if err != nil {
+			logError("Error syncing collection "+fmt.Sprint(flags.configSyncCollection)+": "+err.Error(), true)
+			os.Exit(failureExitCode(err))
+		}
+	case "watch":
+		err = watchFolders()
+		if err != nil {
+			logError("Error watching "+flags.configWatch+": "+err.Error(), true)
+			os.Exit(failureExitCode(err))
+		}
+	case "serve":
+		err = serveJobs()
+		if err != nil {
+			logError("Error serving on "+flags.configListen+": "+err.Error(), true)
+			os.Exit(failureExitCode(err))
+		}
+		return
+	case "update":
+		previous, err := loadIDMap(flags.configPrevious)
+		if err != nil {
+			logError("Error loading previous run "+flags.configPrevious+": "+err.Error(), true)
+			os.Exit(exitValidation)
+		}
+		mustLoadDocuments()
+		updateDocuments(previous)
+		if len(csvLinks) > 0 && !stopRequested() {
+			processLinks()
+		}
+	default:
+		mustLoadDocuments()
+		if len(csvContent) > 0 {
+			processDocuments()
+			if len(csvLinks) > 0 && !stopRequested() {
+				processLinks()
+			}
+		} else {
+			logError("No documents found to import", true)
+			addReport("", "", "load", "failed", "no documents found to import")
 		}
-		processDocuments()
-	} else {
-		logError("No rows found in "+flags.configCSVMain, true)
 	}
+	cleanupSessionFiles()
+	closeArchives()
 	logInfo("Processing Complete!", true)
 
+	err = writeReport()
+	if err != nil {
+		logError("Error writing report "+flags.configReport+": "+err.Error(), true)
+	} else {
+		logInfo("Report written to "+flags.configReport, true)
+	}
+	if flags.configMode == "export" {
+		logInfo("🟢 Documents successfully exported: "+fmt.Sprint(counters.exports.success), true)
+		if counters.exports.failed > 0 {
+			logInfo("🔴 Errors exporting Documents: "+fmt.Sprint(counters.exports.failed), true)
+		}
+		finishRun()
+		return
+	}
+
+	err = saveIDMap(flags.configIDMap)
+	if err != nil {
+		logError("Error writing ID map "+flags.configIDMap+": "+err.Error(), true)
+	} else {
+		logInfo("ID map written to "+flags.configIDMap, true)
+	}
+	if flags.configMode == "migrate" {
+		logInfo("🟢 Documents exported from source instance: "+fmt.Sprint(counters.exports.success), true)
+		if counters.exports.failed > 0 {
+			logInfo("🔴 Errors exporting Documents from source instance: "+fmt.Sprint(counters.exports.failed), true)
+		}
+	}
+	printSummary()
+	finishRun()
+}
+
+//-- Output the import and update counters, and the stage timings
+func printSummary() {
+	if flags.configMode == "sync" {
+		logInfo("🟢 Documents unchanged: "+fmt.Sprint(counters.updates.unchanged), true)
+		logInfo("🟢 Document revisions added: "+fmt.Sprint(counters.updates.revisions), true)
+		logInfo("🟢 Documents archived or removed: "+fmt.Sprint(counters.updates.removed), true)
+		if counters.updates.failed > 0 {
+			logInfo("🔴 Errors syncing Documents: "+fmt.Sprint(counters.updates.failed), true)
+		}
+	}
+	if flags.configMode == "update" {
+		logInfo("🟢 Documents changed: "+fmt.Sprint(counters.updates.changed), true)
+		logInfo("🟢 Documents unchanged: "+fmt.Sprint(counters.updates.unchanged), true)
+		logInfo("🟢 Document metadata updates: "+fmt.Sprint(counters.updates.metadata), true)
+		logInfo("🟢 Document revisions added: "+fmt.Sprint(counters.updates.revisions), true)
+		if counters.updates.failed > 0 {
+			logInfo("🔴 Errors updating Documents: "+fmt.Sprint(counters.updates.failed), true)
+		}
+	}
+
+	if counters.documents.skipped > 0 {
+		logInfo("🟡 Files skipped by filter rules: "+fmt.Sprint(counters.documents.skipped), true)
+	}
+
 	logInfo("🟢 Files added to Hornbill Session: "+fmt.Sprint(counters.session.addSuccess), true)
 	if counters.session.addFailed > 0 {
 		logInfo("🔴 Errors adding files to Hornbill Session: "+fmt.Sprint(counters.session.addFailed), true)
@@ -89,6 +316,13 @@ func main() {
 		logInfo("🔴 Errors adding Documents: "+fmt.Sprint(counters.documents.addFailed), true)
 	}
 
+	if counters.owners.addSuccess+counters.owners.addFailed > 0 {
+		logInfo("🟢 Document Owners successfully set: "+fmt.Sprint(counters.owners.addSuccess), true)
+		if counters.owners.addFailed > 0 {
+			logInfo("🔴 Errors setting Document Owners: "+fmt.Sprint(counters.owners.addFailed), true)
+		}
+	}
+
 	logInfo("🟢 Documents Collections successfully associated: "+fmt.Sprint(counters.collections.addSuccess), true)
 	if counters.collections.addFailed > 0 {
 		logInfo("🔴 Errors adding Documents to Collections: "+fmt.Sprint(counters.collections.addFailed), true)
@@ -100,12 +334,113 @@ func main() {
 	}
 
 	logInfo("🟢 Document Tags successfully applied: "+fmt.Sprint(counters.tags.addSuccess), true)
+	logInfo("🟢 Tags created: "+fmt.Sprint(counters.tags.created)+", existing Tags reused: "+fmt.Sprint(counters.tags.reused), true)
 	if counters.tags.addFailed > 0 {
 		logInfo("🔴 Errors Tagging Documents: "+fmt.Sprint(counters.tags.addFailed), true)
 	}
 
+	if flags.configCSVComments != "" || flags.configImportedFrom != "" {
+		logInfo("🟢 Activity Stream posts successfully created: "+fmt.Sprint(counters.comments.addSuccess), true)
+		if counters.comments.addFailed > 0 {
+			logInfo("🔴 Errors posting to Activity Streams: "+fmt.Sprint(counters.comments.addFailed), true)
+		}
+	}
+
+	if flags.configCSVLinks != "" {
+		logInfo("🟢 Document Links successfully created: "+fmt.Sprint(counters.links.addSuccess), true)
+		if counters.links.addFailed > 0 {
+			logInfo("🔴 Errors Linking Documents: "+fmt.Sprint(counters.links.addFailed), true)
+		}
+	}
+
 	logInfo("🟢 Files cleaned from Hornbill Session: "+fmt.Sprint(counters.session.deleteSuccess), true)
-	if counters.session.addFailed > 0 {
+	if counters.session.deleteFailed > 0 {
 		logInfo("🔴 Errors cleaning files from Hornbill Session: "+fmt.Sprint(counters.session.deleteFailed), true)
 	}
+
+	printStats()
+}
+
+//-- Load the documents for a command line run, which stops on unreadable input
+func mustLoadDocuments() {
+	if err := loadDocuments(); err != nil {
+		logError(err.Error(), true)
+		os.Exit(exitValidation)
+	}
+}
+
+//-- Crawl the source directory or archive, then grab CSV Data
+func loadDocuments() error {
+	if flags.configCrawl != "" {
+		err := getCrawlDocuments(flags.configCrawl)
+		if err != nil {
+			return errors.New("Error crawling " + flags.configCrawl + ": " + err.Error())
+		}
+	}
+	if flags.configCSVMain != "" {
+		setCSVPathBase(flags.configCSVMain)
+		if err := getCSVDocuments(); err != nil {
+			return err
+		}
+	}
+	if len(csvContent) == 0 {
+		return nil
+	}
+	if flags.configCSVShares != "" {
+		if err := getCSVShares(); err != nil {
+			return err
+		}
+	}
+	if flags.configCSVCollections != "" {
+		if err := getCSVCollections(); err != nil {
+			return err
+		}
+	}
+	if flags.configCSVTags != "" {
+		if err := getCSVTags(); err != nil {
+			return err
+		}
+	}
+	if flags.configCSVComments != "" {
+		if err := getCSVComments(); err != nil {
+			return err
+		}
+	}
+	if flags.configCSVLinks != "" {
+		if err := getCSVLinks(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//-- Read-only comparison of the CSVs with the instance. finishRun exits 0 when they match, exitDifferences
+//-- when they differ
+func runDiff() {
+	previous := make(map[string]idMapStruct)
+	if flags.configPrevious != "" {
+		var err error
+		previous, err = loadIDMap(flags.configPrevious)
+		if err != nil {
+			logError("Error loading previous run "+flags.configPrevious+": "+err.Error(), true)
+			os.Exit(exitValidation)
+		}
+	}
+	mustLoadDocuments()
+	report, err := diffDocuments(previous)
+	if err != nil {
+		logError("Error comparing with instance: "+err.Error(), true)
+		os.Exit(failureExitCode(err))
+	}
+	err = outputDiff(report)
+	if err != nil {
+		logError("Error writing differences "+flags.configDiffReport+": "+err.Error(), true)
+	}
+	err = writeReport()
+	if err != nil {
+		logError("Error writing report "+flags.configReport+": "+err.Error(), true)
+	}
+	diffCompared = report.Matched + len(report.Mismatched)
+	diffsFound = report.hasDifferences()
+	finishRun()
 }
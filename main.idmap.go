@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	idMap      = make(map[string]idMapStruct)
+	idMapMutex sync.Mutex
+)
+
+//-- What was imported for a source file, so later runs can work out what has changed
+type idMapStruct struct {
+	DocumentID  string            `json:"documentId"`
+	Hash        string            `json:"hash,omitempty"`
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	Status      string            `json:"status"`
+	ReviewDate  string            `json:"reviewDate,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Collections []int             `json:"collections,omitempty"`
+	Shares      []sharesStruct    `json:"shares,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+
+	//Only the DocumentID and Title are known when loaded from a run report
+	fromReport bool
+}
+
+func newIDMapEntry(file *csvStruct) idMapStruct {
+	entry := idMapStruct{
+		DocumentID:  file.DocumentID,
+		Hash:        file.ContentHash,
+		Title:       file.Title,
+		Description: file.Description,
+		Status:      file.Status,
+		ReviewDate:  file.ReviewDate,
+		Owner:       file.Owner,
+	}
+	for _, field := range file.CustomFields {
+		if entry.Fields == nil {
+			entry.Fields = make(map[string]string)
+		}
+		entry.Fields[field.Field] = field.Value
+	}
+	return entry
+}
+
+//-- The current state of a document on the instance, for a previous run loaded from its report
+func idMapFromInstance(docID string) (idMapStruct, error) {
+	doc, err := readLibraryDocument(targetInstance(), docID)
+	if err != nil {
+		return idMapStruct{}, err
+	}
+	return idMapStruct{
+		DocumentID:  docID,
+		Title:       doc.Title,
+		Description: doc.Description,
+		Status:      doc.Status,
+		ReviewDate:  doc.ReviewDate,
+		Owner:       doc.Owner,
+		Tags:        doc.Tags,
+		Collections: doc.Collections,
+		Shares:      doc.Shares,
+	}, nil
+}
+
+func setIDMap(filePath string, entry idMapStruct) {
+	idMapMutex.Lock()
+	defer idMapMutex.Unlock()
+	idMap[filePath] = entry
+}
+
+func saveIDMap(filename string) error {
+	idMapMutex.Lock()
+	defer idMapMutex.Unlock()
+	content, err := json.MarshalIndent(idMap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+//-- Load the ID map of a previous run, from its JSON ID map or from the document rows of its CSV report
+func loadIDMap(filename string) (map[string]idMapStruct, error) {
+	previous := make(map[string]idMapStruct)
+	if !strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(content, &previous)
+		return previous, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		//Filepath, DocumentID, Stage, Outcome, Detail
+		if len(line) < 5 || line[2] != "document" || line[3] != "success" || line[1] == "" {
+			continue
+		}
+		previous[line[0]] = idMapStruct{DocumentID: line[1], Title: line[4], fromReport: true}
+	}
+	return previous, nil
+}
+
+//-- SHA-256 of a file or archive entry
+func hashSource(filePath string) (string, error) {
+	src, _, err := openSource(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, src)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
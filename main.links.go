@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type linkStruct struct {
+	From     string
+	To       string
+	LinkType string
+}
+
+func getCSVLinks() error {
+	lines, err := readCSV(flags.configCSVLinks)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if strings.ToLower(line[0]) == "frompath" || line[0] == "" {
+			continue
+		}
+		link := linkStruct{
+			From:     resolveCSVPath(line[0]),
+			To:       resolveCSVPath(line[1]),
+			LinkType: strings.TrimSpace(line[2]),
+		}
+		if link.LinkType == "" {
+			link.LinkType = "related"
+		}
+		csvLinks = append(csvLinks, link)
+	}
+	return nil
+}
+
+//-- Second pass, once every document in the batch has been created, to link documents by their source paths
+func processLinks() {
+	logInfo("Processing "+strconv.Itoa(len(csvLinks))+" document links", true)
+	for _, link := range csvLinks {
+		fromID, fromOK := importedDocs[link.From]
+		toID, toOK := importedDocs[link.To]
+		if !fromOK || !toOK {
+			missing := link.From
+			if fromOK {
+				missing = link.To
+			}
+			logError("Unable to link "+link.From+" to "+link.To+": "+missing+" was not imported", true)
+			addReport(link.From, fromID, "link", "failed", link.To+": "+missing+" was not imported")
+			counters.links.addFailed++
+			continue
+		}
+		start := time.Now()
+		err := documentLink(fromID, toID, link.LinkType)
+		recordTiming("link", start)
+		if err != nil {
+			logError(err.Error(), true)
+			addReport(link.From, fromID, "link", "failed", link.To+": "+err.Error())
+			counters.links.addFailed++
+			continue
+		}
+		addReport(link.From, fromID, "link", "success", link.LinkType+" "+link.To+" ("+toID+")")
+		counters.links.addSuccess++
+	}
+}
+
+func documentLink(fromID, toID, linkType string) error {
+	logInfo("Linking Document "+fromID+" to Document "+toID+" as "+linkType, false)
+	espXmlmc.SetParam("documentId", fromID)
+	espXmlmc.SetParam("linkedDocumentId", toID)
+	espXmlmc.SetParam("linkType", linkType)
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("library", "documentAddLink", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Documents Linked Successfully", false)
+	} else {
+		logInfo("[DRYRUN] library::documentAddLink:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-- Upper bounds, in seconds, of the latency histogram buckets
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+//-- Help text and type of each metric, in the order they are written
+var metricInfo = []struct{ name, kind, help string }{
+	{"docimport_run_info", "gauge", "Run ID, mode and version of the importer"},
+	{"docimport_stage_total", "counter", "Processing stage outcomes, as recorded in the run report"},
+	{"docimport_api_calls_total", "counter", "XMLMC API calls by service, method and outcome"},
+	{"docimport_api_call_duration_seconds", "histogram", "XMLMC API call latency, including retries"},
+	{"docimport_api_retries_total", "counter", "XMLMC API calls retried after a connection failure"},
+	{"docimport_dav_upload_bytes_total", "counter", "Bytes uploaded to the Hornbill session over DAV"},
+	{"docimport_dav_upload_duration_seconds", "histogram", "DAV upload latency"},
+	{"docimport_throttled_total", "counter", "Throttling or busy errors from the instance that slowed the importer down"},
+	{"docimport_tag_cache_total", "counter", "Tag lookups by result: hit when the tag ID was cached, miss when it was looked up"},
+}
+
+type histogramStruct struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var metrics = struct {
+	sync.Mutex
+	values     map[string]map[string]float64
+	histograms map[string]map[string]*histogramStruct
+}{
+	values:     make(map[string]map[string]float64),
+	histograms: make(map[string]map[string]*histogramStruct),
+}
+
+//-- Label pairs as they appear in the exposition format, e.g. {service="library",method="tagGetList"}
+func metricLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var labels []string
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+`="`+replacer.Replace(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func metricAdd(name string, value float64, labels ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.values[name] == nil {
+		metrics.values[name] = make(map[string]float64)
+	}
+	metrics.values[name][metricLabels(labels...)] += value
+}
+
+func metricObserve(name string, duration time.Duration, labels ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.histograms[name] == nil {
+		metrics.histograms[name] = make(map[string]*histogramStruct)
+	}
+	key := metricLabels(labels...)
+	h, ok := metrics.histograms[name][key]
+	if !ok {
+		h = &histogramStruct{counts: make([]uint64, len(metricBuckets))}
+		metrics.histograms[name][key] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range metricBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+//-- Write every metric in the Prometheus text exposition format
+func writeMetrics(w io.Writer) error {
+	metricAddInfo()
+	metrics.Lock()
+	defer metrics.Unlock()
+	var b strings.Builder
+	for _, info := range metricInfo {
+		values, histograms := metrics.values[info.name], metrics.histograms[info.name]
+		if len(values) == 0 && len(histograms) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", info.name, info.help, info.name, info.kind)
+		for _, key := range sortedKeys(values) {
+			b.WriteString(info.name + key + " " + strconv.FormatFloat(values[key], 'g', -1, 64) + "\n")
+		}
+		var keys []string
+		for key := range histograms {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			h := histograms[key]
+			labels := strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+			if labels != "" {
+				labels += ","
+			}
+			for i, bound := range metricBuckets {
+				fmt.Fprintf(&b, "%s_bucket{%sle=\"%s\"} %d\n", info.name, labels, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%sle=\"+Inf\"} %d\n", info.name, labels, h.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", info.name, key, strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(&b, "%s_count%s %d\n", info.name, key, h.count)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+//-- Clear the metrics for the next serve job. Scrapers see this as a counter reset
+func resetMetrics() {
+	metrics.Lock()
+	metrics.values = make(map[string]map[string]float64)
+	metrics.histograms = make(map[string]map[string]*histogramStruct)
+	metrics.Unlock()
+}
+
+func metricAddInfo() {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.values["docimport_run_info"] = map[string]float64{
+		metricLabels("run", runID, "mode", flags.configMode, "version", version): 1,
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//-- Serve the metrics on -metricslisten, at /metrics
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+	logInfo("Serving metrics on "+flags.configMetricsListen+"/metrics", true)
+	go func() {
+		err := http.ListenAndServe(flags.configMetricsListen, mux)
+		if err != nil {
+			logError("Error serving metrics on "+flags.configMetricsListen+": "+err.Error(), true)
+		}
+	}()
+}
+
+//-- Write the metrics to -metricsfile for the node exporter textfile collector, through a temporary
+//-- file so the collector never reads a partial file
+func writeMetricsFile(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	err = writeMetrics(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func writeMetricsFileOrLog() {
+	if flags.configMetricsFile == "" {
+		return
+	}
+	err := writeMetricsFile(flags.configMetricsFile)
+	if err != nil {
+		logError("Error writing metrics "+flags.configMetricsFile+": "+err.Error(), true)
+	} else {
+		logInfo("Metrics written to "+flags.configMetricsFile, true)
+	}
+}
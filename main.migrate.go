@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//-- Copy documents from the -sourceinstanceid instance to the target instance, remapping collections and users
+func migrateDocuments() error {
+	workDir := flags.configMigrateDir
+	if workDir == "" {
+		workDir = filepath.Join(logPath, logPrefix+"_"+runTime+"_migrate")
+	}
+
+	//Export from the source instance, using its own connection and API key
+	logInfo("Exporting from source instance "+flags.configSourceInstanceID, true)
+	err := exportDocuments(sourceInstance, workDir)
+	if err != nil {
+		return err
+	}
+	if flags.configTagPrefetch {
+		err = prefetchTags()
+		if err != nil {
+			return err
+		}
+	}
+
+	collectionMap, err := readMap(flags.configCollectionMap)
+	if err != nil {
+		return err
+	}
+	userMap, err := readMap(flags.configUserMap)
+	if err != nil {
+		return err
+	}
+
+	//Import the exported CSVs in to the target instance
+	logInfo("Importing in to target instance "+flags.configInstanceID, true)
+	flags.configCSVMain = filepath.Join(workDir, "docs_main.csv")
+	flags.configCSVShares = filepath.Join(workDir, "docs_shares.csv")
+	flags.configCSVCollections = filepath.Join(workDir, "docs_collections.csv")
+	flags.configCSVTags = filepath.Join(workDir, "docs_tags.csv")
+	csvPathBase = filepath.Clean(workDir) + string(filepath.Separator)
+	mustLoadDocuments()
+	remapDocuments(collectionMap, userMap)
+	if len(csvContent) > 0 {
+		processDocuments()
+	}
+	return writeMigrationMap()
+}
+
+//-- Read a two column CSV of source to target values
+func readMap(filename string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if filename == "" {
+		return mapping, nil
+	}
+	lines, err := readCSV(filename)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range lines {
+		if i == 0 && strings.EqualFold(line[0], "source") {
+			continue
+		}
+		if len(line) > 1 && line[0] != "" {
+			mapping[strings.TrimSpace(line[0])] = strings.TrimSpace(line[1])
+		}
+	}
+	return mapping, nil
+}
+
+//-- Replace source instance collection IDs and users with their target instance equivalents
+func remapDocuments(collectionMap, userMap map[string]string) {
+	remapUser := func(filePath, user string) string {
+		if target, ok := userMap[user]; ok {
+			addReport(filePath, "", "remap", "user", user+" -> "+target)
+			return target
+		}
+		return user
+	}
+	for i := range csvContent {
+		file := &csvContent[i]
+		if file.Owner != "" {
+			file.Owner = remapUser(file.Filepath, file.Owner)
+		}
+
+		var collections []int
+		for _, collectionID := range csvCollections[file.Filepath] {
+			target, ok := collectionMap[strconv.Itoa(collectionID)]
+			if !ok {
+				collections = append(collections, collectionID)
+				continue
+			}
+			targetID, err := strconv.Atoi(target)
+			if err != nil {
+				logError("Invalid target collection ID "+target+" for collection "+strconv.Itoa(collectionID), true)
+				addReport(file.Filepath, "", "remap", "failed", "collection "+strconv.Itoa(collectionID)+" -> "+target)
+				continue
+			}
+			addReport(file.Filepath, "", "remap", "collection", strconv.Itoa(collectionID)+" -> "+target)
+			collections = append(collections, targetID)
+		}
+		if _, ok := csvCollections[file.Filepath]; ok {
+			csvCollections[file.Filepath] = collections
+		}
+
+		for j, share := range csvShares[file.Filepath] {
+			if strings.HasPrefix(share.URN, "urn:sys:user:") {
+				user := strings.TrimPrefix(share.URN, "urn:sys:user:")
+				csvShares[file.Filepath][j].URN = "urn:sys:user:" + remapUser(file.Filepath, user)
+			}
+		}
+	}
+}
+
+//-- Write the source to target document ID mapping report
+func writeMigrationMap() error {
+	filename := flags.configMigrateMap
+	if filename == "" {
+		filename = filepath.Join(logPath, logPrefix+"_"+runTime+"_migration.csv")
+	}
+	rows := [][]string{{"SourceDocumentID", "TargetDocumentID", "Filepath"}}
+	for filePath, sourceID := range exportedDocs {
+		rows = append(rows, []string{sourceID, importedDocs[filePath], filePath})
+	}
+	err := writeCSV(filename, rows)
+	if err != nil {
+		return err
+	}
+	logInfo("Migration map written to "+filename, true)
+	return nil
+}
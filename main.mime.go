@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+//-- MIME types keyed on lower case file extension, used when the content itself is not conclusive
+var mimeExtensions = map[string]string{
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docm": "application/vnd.ms-word.document.macroEnabled.12",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".dot":  "application/msword",
+	".dotx": "application/vnd.openxmlformats-officedocument.wordprocessingml.template",
+	".eml":  "message/rfc822",
+	".gif":  "image/gif",
+	".htm":  "text/html",
+	".html": "text/html",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".json": "application/json",
+	".md":   "text/markdown",
+	".msg":  "application/vnd.ms-outlook",
+	".odg":  "application/vnd.oasis.opendocument.graphics",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".pdf":  "application/pdf",
+	".png":  "image/png",
+	".pps":  "application/vnd.ms-powerpoint",
+	".ppsx": "application/vnd.openxmlformats-officedocument.presentationml.slideshow",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptm": "application/vnd.ms-powerpoint.presentation.macroEnabled.12",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".rtf":  "application/rtf",
+	".svg":  "image/svg+xml",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".txt":  "text/plain",
+	".vsd":  "application/vnd.visio",
+	".vsdx": "application/vnd.ms-visio.drawing",
+	".xls":  "application/vnd.ms-excel",
+	".xlsm": "application/vnd.ms-excel.sheet.macroEnabled.12",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".xlt":  "application/vnd.ms-excel",
+	".xltx": "application/vnd.openxmlformats-officedocument.spreadsheetml.template",
+	".xml":  "application/xml",
+	".zip":  "application/zip",
+}
+
+//-- OOXML main part content types from [Content_Types].xml, mapped to the MIME type of the package
+var ooxmlMainParts = []struct {
+	part     string
+	mimeType string
+}{
+	{"wordprocessingml.document.main+xml", mimeExtensions[".docx"]},
+	{"wordprocessingml.template.main+xml", mimeExtensions[".dotx"]},
+	{"ms-word.document.macroEnabled.main+xml", mimeExtensions[".docm"]},
+	{"spreadsheetml.sheet.main+xml", mimeExtensions[".xlsx"]},
+	{"spreadsheetml.template.main+xml", mimeExtensions[".xltx"]},
+	{"ms-excel.sheet.macroEnabled.main+xml", mimeExtensions[".xlsm"]},
+	{"presentationml.presentation.main+xml", mimeExtensions[".pptx"]},
+	{"presentationml.slideshow.main+xml", mimeExtensions[".ppsx"]},
+	{"ms-powerpoint.presentation.macroEnabled.main+xml", mimeExtensions[".pptm"]},
+	{"ms-visio.drawing.main+xml", mimeExtensions[".vsdx"]},
+}
+
+//-- Leading byte signatures for formats http.DetectContentType does not know about, or gets wrong
+var mimeSignatures = []struct {
+	magic    []byte
+	mimeType string
+}{
+	{[]byte("%PDF-"), "application/pdf"},
+	{[]byte("{\\rtf"), "application/rtf"},
+	{[]byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{[]byte("\xff\xd8\xff"), "image/jpeg"},
+	{[]byte("GIF87a"), "image/gif"},
+	{[]byte("GIF89a"), "image/gif"},
+	{[]byte("II*\x00"), "image/tiff"},
+	{[]byte("MM\x00*"), "image/tiff"},
+	{[]byte("\x1f\x8b"), "application/gzip"},
+	{[]byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{[]byte("Rar!\x1a\x07"), "application/vnd.rar"},
+}
+
+//-- Number of leading bytes read from each file for content type detection
+const mimeSniffLen = 8192
+
+var (
+	zipMagic = []byte("PK\x03\x04")
+	cfbMagic = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+)
+
+//-- Load the extension to MIME type override map from a JSON file
+func loadMimeOverrides(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	overrides := make(map[string]string)
+	err = json.Unmarshal(content, &overrides)
+	if err != nil {
+		return err
+	}
+	for ext, mimeType := range overrides {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		mimeOverrides[ext] = mimeType
+	}
+	return nil
+}
+
+//-- Work out the MIME type of a file from its name and leading bytes. When the whole file is available
+//-- through ra, zip and OLE2 containers are inspected to tell the office formats apart.
+func detectContentType(filename string, header []byte, ra io.ReaderAt, size int64) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if mimeType, ok := mimeOverrides[ext]; ok {
+		return mimeType
+	}
+
+	switch {
+	case bytes.HasPrefix(header, zipMagic):
+		if mimeType := zipContentType(header, ra, size, ext); mimeType != "" {
+			return mimeType
+		}
+	case bytes.HasPrefix(header, cfbMagic):
+		if mimeType := cfbContentType(header, ra, size, ext); mimeType != "" {
+			return mimeType
+		}
+	}
+	for _, sig := range mimeSignatures {
+		if bytes.HasPrefix(header, sig.magic) {
+			return sig.mimeType
+		}
+	}
+	if mimeType, ok := mimeExtensions[ext]; ok {
+		return mimeType
+	}
+	return http.DetectContentType(header)
+}
+
+//-- Work out the type of a zip container from its ODF mimetype entry or OOXML content types
+func zipContentType(header []byte, ra io.ReaderAt, size int64, ext string) string {
+	if ra == nil {
+		//ODF stores an uncompressed mimetype entry first, so it can be read from the local file header
+		if len(header) > 38 && string(header[30:38]) == "mimetype" {
+			length := int(binary.LittleEndian.Uint32(header[18:22]))
+			if 38+length <= len(header) {
+				return string(header[38 : 38+length])
+			}
+		}
+		if mimeType, ok := mimeExtensions[ext]; ok {
+			return mimeType
+		}
+		return "application/zip"
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return ""
+	}
+	for _, f := range zr.File {
+		switch f.Name {
+		case "mimetype":
+			entry, err := readZipEntry(f)
+			if err == nil && len(entry) > 0 {
+				return strings.TrimSpace(string(entry))
+			}
+		case "[Content_Types].xml":
+			entry, err := readZipEntry(f)
+			if err != nil {
+				continue
+			}
+			for _, mainPart := range ooxmlMainParts {
+				if bytes.Contains(entry, []byte(mainPart.part)) {
+					return mainPart.mimeType
+				}
+			}
+		}
+	}
+	if mimeType, ok := mimeExtensions[ext]; ok {
+		return mimeType
+	}
+	return "application/zip"
+}
+
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+//-- Work out the type of an OLE2 compound file from the stream names in its directory
+func cfbContentType(header []byte, ra io.ReaderAt, size int64, ext string) string {
+	var names []string
+	if ra != nil {
+		names = cfbStreamNames(ra, size)
+	}
+	has := func(name string) bool {
+		if ra == nil {
+			return bytes.Contains(header, utf16Bytes(name))
+		}
+		for _, n := range names {
+			if strings.HasPrefix(n, name) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("__substg1.0_"):
+		return mimeExtensions[".msg"]
+	case has("WordDocument"):
+		return mimeExtensions[".doc"]
+	case has("Workbook"):
+		return mimeExtensions[".xls"]
+	case has("PowerPoint Document"):
+		return mimeExtensions[".ppt"]
+	case has("VisioDocument"):
+		return mimeExtensions[".vsd"]
+	}
+	if mimeType, ok := mimeExtensions[ext]; ok {
+		return mimeType
+	}
+	return ""
+}
+
+//-- Upper bound on the directory and FAT sectors read from a compound file, so a corrupt chain cannot loop
+const cfbMaxSectors = 4096
+
+//-- Read the stream names from a compound file's directory, following its sector chain through the FAT
+//-- rather than reading the whole file. Returns what was read before any error
+func cfbStreamNames(ra io.ReaderAt, size int64) []string {
+	hdr := make([]byte, 512)
+	if _, err := ra.ReadAt(hdr, 0); err != nil {
+		return nil
+	}
+	shift := binary.LittleEndian.Uint16(hdr[30:32])
+	if shift < 7 || shift > 16 {
+		return nil
+	}
+	sectorSize := int64(1) << shift
+	perSector := sectorSize / 4
+	readSector := func(sector uint32) []byte {
+		buf := make([]byte, sectorSize)
+		offset := (int64(sector) + 1) * sectorSize
+		if offset+sectorSize > size {
+			return nil
+		}
+		if _, err := ra.ReadAt(buf, offset); err != nil {
+			return nil
+		}
+		return buf
+	}
+
+	//FAT sector locations: the first 109 are in the header, the rest in the DIFAT chain
+	var fatSectors []uint32
+	for i := 0; i < 109; i++ {
+		fatSectors = append(fatSectors, binary.LittleEndian.Uint32(hdr[76+i*4:]))
+	}
+	difat := binary.LittleEndian.Uint32(hdr[68:72])
+	for n := 0; difat < 0xFFFFFFFA && n < cfbMaxSectors; n++ {
+		buf := readSector(difat)
+		if buf == nil {
+			break
+		}
+		for i := int64(0); i < perSector-1; i++ {
+			fatSectors = append(fatSectors, binary.LittleEndian.Uint32(buf[i*4:]))
+		}
+		difat = binary.LittleEndian.Uint32(buf[(perSector-1)*4:])
+	}
+	fatCache := make(map[uint32][]byte)
+	next := func(sector uint32) uint32 {
+		index := int64(sector) / perSector
+		if index >= int64(len(fatSectors)) {
+			return 0xFFFFFFFE
+		}
+		fat, ok := fatCache[fatSectors[index]]
+		if !ok {
+			fat = readSector(fatSectors[index])
+			fatCache[fatSectors[index]] = fat
+		}
+		if fat == nil {
+			return 0xFFFFFFFE
+		}
+		return binary.LittleEndian.Uint32(fat[(int64(sector)%perSector)*4:])
+	}
+
+	var names []string
+	sector := binary.LittleEndian.Uint32(hdr[48:52])
+	for n := 0; sector < 0xFFFFFFFA && n < cfbMaxSectors; n++ {
+		buf := readSector(sector)
+		if buf == nil {
+			break
+		}
+		for entry := int64(0); entry+128 <= sectorSize; entry += 128 {
+			length := int(binary.LittleEndian.Uint16(buf[entry+64:]))
+			if length < 2 || length > 64 {
+				continue
+			}
+			var units []uint16
+			for i := 0; i < length-2; i += 2 {
+				units = append(units, binary.LittleEndian.Uint16(buf[entry+int64(i):]))
+			}
+			names = append(names, string(utf16.Decode(units)))
+		}
+		sector = next(sector)
+	}
+	return names
+}
+
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r), byte(r>>8))
+	}
+	return b
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"testing"
+)
+
+//-- Build a compound file with 512 byte sectors, one FAT sector at sector 0, and the given sectors after it.
+//-- fat gives the next sector for each sector from 1 on, and dir is the first directory sector
+func buildCFB(dir uint32, fat []uint32, sectors [][]string) []byte {
+	hdr := make([]byte, 512)
+	copy(hdr, cfbMagic)
+	binary.LittleEndian.PutUint16(hdr[30:], 9)
+	binary.LittleEndian.PutUint32(hdr[48:], dir)
+	binary.LittleEndian.PutUint32(hdr[68:], 0xFFFFFFFE)
+	for i := 0; i < 109; i++ {
+		binary.LittleEndian.PutUint32(hdr[76+i*4:], 0xFFFFFFFF)
+	}
+	binary.LittleEndian.PutUint32(hdr[76:], 0)
+
+	fatSector := make([]byte, 512)
+	for i := 0; i < 128; i++ {
+		binary.LittleEndian.PutUint32(fatSector[i*4:], 0xFFFFFFFF)
+	}
+	binary.LittleEndian.PutUint32(fatSector, 0xFFFFFFFD)
+	for i, next := range fat {
+		binary.LittleEndian.PutUint32(fatSector[(i+1)*4:], next)
+	}
+
+	out := append(hdr, fatSector...)
+	for _, names := range sectors {
+		sector := make([]byte, 512)
+		for i, name := range names {
+			entry := sector[i*128:]
+			encoded := utf16Bytes(name)
+			copy(entry, encoded)
+			binary.LittleEndian.PutUint16(entry[64:], uint16(len(encoded)+2))
+		}
+		out = append(out, sector...)
+	}
+	return out
+}
+
+func TestCFBStreamNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     uint32
+		fat     []uint32
+		sectors [][]string
+		want    []string
+	}{
+		{
+			name:    "single sector",
+			dir:     1,
+			fat:     []uint32{0xFFFFFFFE},
+			sectors: [][]string{{"Root Entry", "WordDocument"}},
+			want:    []string{"Root Entry", "WordDocument"},
+		},
+		{
+			name:    "chain skips a sector that is not part of the directory",
+			dir:     1,
+			fat:     []uint32{3, 0xFFFFFFFE, 0xFFFFFFFE},
+			sectors: [][]string{{"Root Entry"}, {"Workbook"}, {"__substg1.0_0037001F"}},
+			want:    []string{"Root Entry", "__substg1.0_0037001F"},
+		},
+		{
+			name:    "chain starting after the first sector",
+			dir:     2,
+			fat:     []uint32{0xFFFFFFFE, 0xFFFFFFFE},
+			sectors: [][]string{{"WordDocument"}, {"Root Entry", "Workbook"}},
+			want:    []string{"Root Entry", "Workbook"},
+		},
+		{
+			name:    "chain past the end of the file",
+			dir:     1,
+			fat:     []uint32{9},
+			sectors: [][]string{{"Root Entry"}},
+			want:    []string{"Root Entry"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := buildCFB(tt.dir, tt.fat, tt.sectors)
+			got := cfbStreamNames(bytes.NewReader(content), int64(len(content)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cfbStreamNames() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCFBStreamNamesLoop(t *testing.T) {
+	content := buildCFB(1, []uint32{1}, [][]string{{"Root Entry"}})
+	got := cfbStreamNames(bytes.NewReader(content), int64(len(content)))
+	if len(got) != cfbMaxSectors {
+		t.Errorf("cfbStreamNames() read %d names from a looping chain, want %d", len(got), cfbMaxSectors)
+	}
+}
+
+func TestCFBContentType(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		streams  []string
+		want     string
+	}{
+		{"word", "a.bin", []string{"Root Entry", "WordDocument"}, mimeExtensions[".doc"]},
+		{"excel", "a.bin", []string{"Root Entry", "Workbook"}, mimeExtensions[".xls"]},
+		{"outlook", "a.doc", []string{"Root Entry", "__substg1.0_0037001F"}, mimeExtensions[".msg"]},
+		{"unknown streams fall back to the extension", "a.ppt", []string{"Root Entry"}, mimeExtensions[".ppt"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := buildCFB(1, []uint32{0xFFFFFFFE}, [][]string{tt.streams})
+			got := detectContentType(tt.filename, content[:512], bytes.NewReader(content), int64(len(content)))
+			if got != tt.want {
+				t.Errorf("detectContentType(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+type zipEntry struct {
+	name    string
+	content string
+	stored  bool
+}
+
+func buildZip(t *testing.T, entries []zipEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		var w io.Writer
+		var err error
+		if entry.stored {
+			//Written raw so the sizes are in the local file header, as ODF requires of its mimetype entry
+			w, err = zw.CreateRaw(&zip.FileHeader{
+				Name:               entry.name,
+				Method:             zip.Store,
+				CRC32:              crc32.ChecksumIEEE([]byte(entry.content)),
+				CompressedSize64:   uint64(len(entry.content)),
+				UncompressedSize64: uint64(len(entry.content)),
+			})
+		} else {
+			w, err = zw.Create(entry.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestZipContentType(t *testing.T) {
+	odt := []zipEntry{
+		{name: "mimetype", content: "application/vnd.oasis.opendocument.text", stored: true},
+		{name: "content.xml", content: "<office:document-content/>"},
+	}
+	docx := []zipEntry{
+		{name: "[Content_Types].xml", content: `<Types><Override PartName="/word/document.xml" ` +
+			`ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/></Types>`},
+		{name: "word/document.xml", content: "<w:document/>"},
+	}
+	xlsx := []zipEntry{
+		{name: "[Content_Types].xml", content: `<Types><Override PartName="/xl/workbook.xml" ` +
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/></Types>`},
+	}
+	plain := []zipEntry{{name: "readme.txt", content: "hello"}}
+
+	tests := []struct {
+		name     string
+		filename string
+		entries  []zipEntry
+		headOnly bool
+		want     string
+	}{
+		{"odf mimetype entry", "a.zip", odt, false, mimeExtensions[".odt"]},
+		{"odf mimetype from the local file header", "a.zip", odt, true, mimeExtensions[".odt"]},
+		{"ooxml word", "a.bin", docx, false, mimeExtensions[".docx"]},
+		{"ooxml excel named as word", "a.docx", xlsx, false, mimeExtensions[".xlsx"]},
+		{"plain zip falls back to the extension", "a.docx", plain, false, mimeExtensions[".docx"]},
+		{"plain zip", "a.bin", plain, false, "application/zip"},
+		{"header only falls back to the extension", "a.xlsx", docx, true, mimeExtensions[".xlsx"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := buildZip(t, tt.entries)
+			header := content
+			if len(header) > 512 {
+				header = header[:512]
+			}
+			var got string
+			if tt.headOnly {
+				got = detectContentType(tt.filename, header, nil, 0)
+			} else {
+				got = detectContentType(tt.filename, header, bytes.NewReader(content), int64(len(content)))
+			}
+			if got != tt.want {
+				t.Errorf("detectContentType(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//-- Width of the progress bar itself, and of the whole line when $COLUMNS is not set
+const (
+	progressBarWidth  = 20
+	progressLineWidth = 120
+)
+
+type progressStageStruct struct {
+	success int
+	failed  int
+}
+
+//-- Progress of the current processDocuments run, drawn as a bar on a terminal or logged as periodic status lines
+var progress struct {
+	sync.Mutex
+	active     bool
+	bar        bool
+	drawn      bool
+	total      int
+	done       int
+	bytes      int64
+	current    string
+	started    time.Time
+	stages     map[string]*progressStageStruct
+	stageOrder []string
+	stop       chan struct{}
+	stopped    chan struct{}
+}
+
+//-- Writes log output above the progress bar, redrawing the bar after each write
+type progressWriter struct {
+	out io.Writer
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	progress.Lock()
+	defer progress.Unlock()
+	if progress.drawn {
+		io.WriteString(w.out, "\r\033[K")
+	}
+	n, err := w.out.Write(p)
+	if progress.active {
+		io.WriteString(w.out, progressLine())
+		progress.drawn = true
+	}
+	return n, err
+}
+
+//-- Work out how progress should be shown for -progress: a bar when stdout is a terminal, otherwise status lines
+func progressMode() string {
+	mode := flags.configProgress
+	if flags.configMode == "watch" || flags.configMode == "serve" {
+		return "off"
+	}
+	if mode != "auto" {
+		return mode
+	}
+	if logJSON {
+		return "lines"
+	}
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return "bar"
+	}
+	return "lines"
+}
+
+//-- Start showing progress through the given files
+func progressStart(files []csvStruct) {
+	mode := progressMode()
+	if mode == "off" {
+		return
+	}
+	progressStop()
+
+	progress.Lock()
+	progress.active = true
+	progress.bar = mode == "bar"
+	progress.drawn = false
+	progress.total = len(files)
+	progress.done = 0
+	progress.bytes = 0
+	progress.current = ""
+	progress.started = time.Now()
+	progress.stages = make(map[string]*progressStageStruct)
+	progress.stageOrder = nil
+	progress.stop = make(chan struct{})
+	progress.stopped = make(chan struct{})
+	stop, stopped := progress.stop, progress.stopped
+	progress.Unlock()
+
+	interval := time.Duration(flags.configProgressInterval) * time.Second
+	if mode == "bar" {
+		interval = 250 * time.Millisecond
+		logStdOut.SetOutput(progressWriter{out: os.Stdout})
+	}
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				progressDraw()
+			}
+		}
+	}()
+}
+
+//-- Stop showing progress, leaving the final state on screen
+func progressStop() {
+	progress.Lock()
+	if !progress.active {
+		progress.Unlock()
+		return
+	}
+	stop, stopped, bar := progress.stop, progress.stopped, progress.bar
+	progress.Unlock()
+	close(stop)
+	<-stopped
+	progressDraw()
+
+	progress.Lock()
+	progress.active = false
+	if bar {
+		fmt.Fprintln(os.Stdout)
+		progress.drawn = false
+	}
+	progress.Unlock()
+	if bar {
+		logStdOut.SetOutput(os.Stdout)
+	}
+}
+
+func progressDraw() {
+	progress.Lock()
+	if !progress.active {
+		progress.Unlock()
+		return
+	}
+	line := progressLine()
+	if progress.bar {
+		io.WriteString(os.Stdout, "\r\033[K"+line)
+		progress.drawn = true
+		progress.Unlock()
+		return
+	}
+	progress.Unlock()
+	logInfo("Progress: "+line, true)
+}
+
+func progressFile(filePath string) {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.current = filePath
+}
+
+func progressFileDone() {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.done++
+	progress.current = ""
+}
+
+func progressBytes(n int64) {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.bytes += n
+}
+
+//-- Count a stage outcome recorded in the report
+func progressStage(stage, outcome string) {
+	progress.Lock()
+	defer progress.Unlock()
+	if !progress.active {
+		return
+	}
+	counts, ok := progress.stages[stage]
+	if !ok {
+		counts = &progressStageStruct{}
+		progress.stages[stage] = counts
+		progress.stageOrder = append(progress.stageOrder, stage)
+	}
+	switch outcome {
+	case "failed":
+		counts.failed++
+	case "skipped":
+	default:
+		counts.success++
+	}
+}
+
+//-- The status line, called with progress locked
+func progressLine() string {
+	elapsed := time.Since(progress.started).Seconds()
+	var percent float64
+	if progress.total > 0 {
+		percent = float64(progress.done) / float64(progress.total)
+	}
+	var filesPerSec, mbPerSec float64
+	if elapsed > 0 {
+		filesPerSec = float64(progress.done) / elapsed
+		mbPerSec = float64(progress.bytes) / elapsed / 1e6
+	}
+	eta := "--"
+	if progress.done > 0 {
+		remaining := time.Duration(elapsed/float64(progress.done)*float64(progress.total-progress.done)) * time.Second
+		eta = remaining.Round(time.Second).String()
+	}
+
+	var b strings.Builder
+	if progress.bar {
+		filled := int(percent * progressBarWidth)
+		b.WriteString("[" + strings.Repeat("#", filled) + strings.Repeat(".", progressBarWidth-filled) + "] ")
+	}
+	fmt.Fprintf(&b, "%d/%d (%.0f%%) %.1f files/s %.2f MB/s ETA %s", progress.done, progress.total, percent*100, filesPerSec, mbPerSec, eta)
+	for _, stage := range progress.stageOrder {
+		counts := progress.stages[stage]
+		b.WriteString(" | " + stage + " " + strconv.Itoa(counts.success) + " ok")
+		if counts.failed > 0 {
+			b.WriteString(" " + strconv.Itoa(counts.failed) + " failed")
+		}
+	}
+	if progress.current != "" {
+		b.WriteString(" | worker 1: " + progress.current)
+	}
+	line := b.String()
+	if progress.bar {
+		width := progressLineWidth
+		if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+			width = columns
+		}
+		if runes := []rune(line); len(runes) >= width {
+			line = string(runes[:width-1])
+		}
+	}
+	return line
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- Longest delay added between calls while the instance reports it is throttling or busy
+const throttleMaxDelay = 60 * time.Second
+
+//-- Paces events to a rate per second, reserving a slot for each so callers queue up behind each other
+type rateLimitStruct struct {
+	sync.Mutex
+	rate float64
+	next time.Time
+}
+
+var (
+	readLimit  = &rateLimitStruct{}
+	writeLimit = &rateLimitStruct{}
+	byteLimit  = &rateLimitStruct{}
+)
+
+//-- Slow-down added in front of every call after a throttling or busy error, halving with each success
+var throttle struct {
+	sync.Mutex
+	delay time.Duration
+}
+
+//-- Start and end of -window, in minutes after midnight
+var (
+	windowSet   bool
+	windowStart int
+	windowEnd   int
+)
+
+//-- Wait until n more events are allowed
+func (l *rateLimitStruct) wait(n float64) {
+	l.Lock()
+	if l.rate <= 0 {
+		l.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(n / l.rate * float64(time.Second)))
+	l.Unlock()
+	time.Sleep(delay)
+}
+
+//-- Set up the limiters from -ratereads, -ratewrites, -ratebytes and -window
+func loadRateLimits() error {
+	readLimit.rate = flags.configRateReads
+	writeLimit.rate = flags.configRateWrites
+	bytesPerSec, err := parseSize(flags.configRateBytes)
+	if err != nil {
+		return errors.New("invalid -ratebytes " + flags.configRateBytes)
+	}
+	byteLimit.rate = float64(bytesPerSec)
+	if flags.configWindow != "" {
+		parts := strings.Split(flags.configWindow, "-")
+		if len(parts) != 2 {
+			return errors.New("invalid -window " + flags.configWindow + ", expected HH:MM-HH:MM")
+		}
+		for i, part := range parts {
+			t, err := time.Parse("15:04", strings.TrimSpace(part))
+			if err != nil {
+				return errors.New("invalid -window " + flags.configWindow + ", expected HH:MM-HH:MM")
+			}
+			if i == 0 {
+				windowStart = t.Hour()*60 + t.Minute()
+			} else {
+				windowEnd = t.Hour()*60 + t.Minute()
+			}
+		}
+		windowSet = windowStart != windowEnd
+	}
+	return nil
+}
+
+//-- Reads are the methods that only fetch, such as tagGetList or getSessionInfo, everything else is a write
+func isReadMethod(method string) bool {
+	for _, prefix := range []string{"get", "list", "browse", "search", "query"} {
+		if strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	for _, word := range []string{"Get", "List", "Browse", "Search", "Query"} {
+		if strings.Contains(method, word) {
+			return true
+		}
+	}
+	return false
+}
+
+//-- Wait for the rate limit of the method's class, and any throttling slow-down
+func rateWaitCall(method string) {
+	if isReadMethod(method) {
+		readLimit.wait(1)
+	} else {
+		writeLimit.wait(1)
+	}
+	throttleWait()
+}
+
+//-- XMLMC state codes the instance answers with when it is rate limiting calls or too busy to take them
+var throttleStateCodes = map[string]bool{"0429": true, "0503": true}
+
+//-- An HTTP status other than success from the instance
+type httpStatusError struct {
+	status  int
+	message string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.message
+}
+
+//-- Invoke fails with "Invalid HTTP Response" when the instance answers with a status other than 200,
+//-- so keep that status with the error. Failed connections are returned as they are
+func invokeStatusError(conn *apiLib.XmlmcInstStruct, err error) error {
+	if _, failed := err.(*url.Error); failed || conn.GetStatusCode() == http.StatusOK {
+		return err
+	}
+	return &httpStatusError{status: conn.GetStatusCode(), message: err.Error()}
+}
+
+//-- Whether the instance answered that it is throttling us or too busy: a 429 or 503 status, or one of
+//-- the matching XMLMC state codes
+func isThrottleError(err error) bool {
+	switch e := err.(type) {
+	case *httpStatusError:
+		return e.status == http.StatusTooManyRequests || e.status == http.StatusServiceUnavailable
+	case *xmlmcError:
+		return throttleStateCodes[e.code]
+	}
+	return false
+}
+
+//-- Slow down after the instance throttles us or is too busy, and speed back up with each success. Other
+//-- errors leave the delay as it is
+func throttleRecord(err error) {
+	throttle.Lock()
+	defer throttle.Unlock()
+	if err == nil {
+		throttle.delay /= 2
+		if throttle.delay < 100*time.Millisecond {
+			throttle.delay = 0
+		}
+		return
+	}
+	if !isThrottleError(err) {
+		return
+	}
+	throttle.delay *= 2
+	if throttle.delay < time.Second {
+		throttle.delay = time.Second
+	}
+	if throttle.delay > throttleMaxDelay {
+		throttle.delay = throttleMaxDelay
+	}
+	logInfo("Instance is throttling or busy ("+err.Error()+"), slowing down to one call every "+throttle.delay.String(), true)
+	metricAdd("docimport_throttled_total", 1)
+}
+
+func throttleWait() {
+	throttle.Lock()
+	delay := throttle.delay
+	throttle.Unlock()
+	time.Sleep(delay)
+}
+
+//-- Limits reads to -ratebytes, for DAV uploads
+type rateLimitReader struct {
+	r io.Reader
+}
+
+func (rr rateLimitReader) Read(p []byte) (int, error) {
+	//Read in small chunks so the pacing stays smooth
+	if byteLimit.rate > 0 && len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := rr.r.Read(p)
+	if n > 0 {
+		byteLimit.wait(float64(n))
+	}
+	return n, err
+}
+
+func inWindow(now time.Time) bool {
+	if !windowSet {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if windowStart < windowEnd {
+		return minute >= windowStart && minute < windowEnd
+	}
+	return minute >= windowStart || minute < windowEnd
+}
+
+//-- Wait until the time is within -window before starting on the next document
+func waitForWindow() {
+	if inWindow(time.Now()) {
+		return
+	}
+	logInfo("Outside -window "+flags.configWindow+", waiting", true)
+	for !inWindow(time.Now()) {
+		if stopRequested() {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	logInfo("Inside -window "+flags.configWindow+", continuing", true)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsThrottleError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many requests", &httpStatusError{status: 429, message: "429 Too Many Requests"}, true},
+		{"service unavailable", &httpStatusError{status: 503, message: "503 Service Unavailable"}, true},
+		{"not found", &httpStatusError{status: 404, message: "404 Not Found"}, false},
+		{"throttling state code", &xmlmcError{code: "0429", message: "Request limit reached"}, true},
+		{"method failure mentioning 503", &xmlmcError{code: "0200", message: "Document 503 is busy being edited"}, false},
+		{"path containing 429", errors.New("open /data/429/report.pdf: no such file or directory"), false},
+		{"connection failure", errors.New("dial tcp: connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := isThrottleError(tt.err); got != tt.want {
+			t.Errorf("isThrottleError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	reportRows  []reportStruct
+	reportMutex sync.Mutex
+)
+
+//-- Set once rows have been written to -report and dropped by a long-running watch, with the number
+//-- of rows written that way
+var (
+	reportFlushed bool
+	flushedRows   int
+)
+
+type reportStruct struct {
+	Filepath   string `json:"filepath"`
+	DocumentID string `json:"documentId,omitempty"`
+	Stage      string `json:"stage"`
+	Outcome    string `json:"outcome"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+//-- Record the outcome of a processing stage for a file, for inclusion in the run report
+func addReport(filePath, documentID, stage, outcome, detail string) {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	reportRows = append(reportRows, reportStruct{
+		Filepath:   filePath,
+		DocumentID: documentID,
+		Stage:      stage,
+		Outcome:    outcome,
+		Detail:     detail,
+	})
+	progressStage(stage, outcome)
+	metricAdd("docimport_stage_total", 1, "stage", stage, "outcome", outcome)
+	if outcome == "failed" && isAuthError(detail) {
+		atomic.AddInt32(&authFailures, 1)
+	}
+}
+
+func reportLen() int {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	return len(reportRows)
+}
+
+//-- The report rows added since the report held n rows
+func reportSince(n int) []reportStruct {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	if n < 0 || n > len(reportRows) {
+		return nil
+	}
+	return append([]reportStruct(nil), reportRows[n:]...)
+}
+
+func writeReport() error {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	if reportFlushed {
+		return appendReportRows(append(append([]reportStruct(nil), reportRows...), statsReportRows()...))
+	}
+	f, err := os.Create(flags.configReport)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeReportRows(f, append(append([]reportStruct(nil), reportRows...), statsReportRows()...))
+}
+
+//-- Write the rows added since the last flush to -report and drop them, so a watch running for weeks
+//-- neither holds every row in memory nor rewrites the whole report each interval. The counters and
+//-- timings are written once, when the watch stops
+func flushReport() error {
+	reportMutex.Lock()
+	defer reportMutex.Unlock()
+	var err error
+	if reportFlushed {
+		err = appendReportRows(reportRows)
+	} else {
+		var f *os.File
+		f, err = os.Create(flags.configReport)
+		if err != nil {
+			return err
+		}
+		err = writeReportRows(f, reportRows)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	flushedRows += len(reportRows)
+	reportRows = nil
+	reportFlushed = true
+	return nil
+}
+
+//-- Every row of the run, reading back those a watch has already flushed to -report
+func allReportRows() ([]reportStruct, error) {
+	reportMutex.Lock()
+	flushed, count := reportFlushed, flushedRows
+	reportMutex.Unlock()
+	if !flushed {
+		return reportSince(0), nil
+	}
+	f, err := os.Open(flags.configReport)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	if _, err := r.Read(); err != nil {
+		return nil, err
+	}
+	var rows []reportStruct
+	for len(rows) < count {
+		line, err := r.Read()
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, reportStruct{Filepath: line[0], DocumentID: line[1], Stage: line[2], Outcome: line[3], Detail: line[4]})
+	}
+	return append(rows, reportSince(0)...), nil
+}
+
+func appendReportRows(rows []reportStruct) error {
+	f, err := os.OpenFile(flags.configReport, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	for _, row := range rows {
+		err = w.Write([]string{row.Filepath, row.DocumentID, row.Stage, row.Outcome, row.Detail})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func writeReportRows(out io.Writer, rows []reportStruct) error {
+	w := csv.NewWriter(out)
+	err := w.Write([]string{"Filepath", "DocumentID", "Stage", "Outcome", "Detail"})
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err = w.Write([]string{row.Filepath, row.DocumentID, row.Stage, row.Outcome, row.Detail})
+		if err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//-- Job statuses
+const (
+	jobQueued      = "queued"
+	jobRunning     = "running"
+	jobCompleted   = "completed"
+	jobFailed      = "failed"
+	jobCancelled   = "cancelled"
+	jobInterrupted = "interrupted"
+)
+
+//-- Names of the CSV parts or fields a job can be submitted with, and the flags they stand in for
+var jobCSVNames = []string{"csvd", "csvs", "csvc", "csvt", "csva", "csvl"}
+
+//-- An import submitted over HTTP. Jobs share the importer's global state, so they run one at a time
+type jobStruct struct {
+	ID        string            `json:"id"`
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	Submitted time.Time         `json:"submitted"`
+	Started   *time.Time        `json:"started,omitempty"`
+	Finished  *time.Time        `json:"finished,omitempty"`
+	CSVs      map[string]string `json:"csvs,omitempty"`
+	Crawl     string            `json:"crawl,omitempty"`
+	Root      string            `json:"root,omitempty"`
+	Total     int               `json:"total"`
+	Processed int               `json:"processed"`
+	Imported  int               `json:"imported"`
+	Failed    int               `json:"failed"`
+	Rows      []jobRowStruct    `json:"rows,omitempty"`
+	paths     []string
+	ended     bool
+	stopped   bool
+}
+
+//-- Progress of a single row of a job
+type jobRowStruct struct {
+	Filepath   string `json:"filepath"`
+	DocumentID string `json:"documentId,omitempty"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+//-- Server side paths for a job submitted as JSON
+type jobRequestStruct struct {
+	CSVD  string `json:"csvd"`
+	CSVS  string `json:"csvs"`
+	CSVC  string `json:"csvc"`
+	CSVT  string `json:"csvt"`
+	CSVA  string `json:"csva"`
+	CSVL  string `json:"csvl"`
+	Crawl string `json:"crawl"`
+}
+
+var (
+	jobs       = make(map[string]*jobStruct)
+	jobsMutex  sync.Mutex
+	jobQueue   = make(chan string, 1024)
+	currentJob string
+	jobsActive sync.WaitGroup
+)
+
+//-- Serve the job API on -listen, running submitted jobs in the background
+func serveJobs() error {
+	err := os.MkdirAll(flags.configServeDir, 0755)
+	if err != nil {
+		return err
+	}
+	err = loadJobs()
+	if err != nil {
+		return errors.New("error loading jobs from " + flags.configServeDir + ": " + err.Error())
+	}
+	go runJobs()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", serveAuth(handleJobs))
+	mux.HandleFunc("/jobs/", serveAuth(handleJob))
+	server := &http.Server{Addr: flags.configListen, Handler: mux}
+	go func() {
+		<-shutdown
+		//No job starts once shutting down, so wait for the one in progress, if any, to finish
+		jobsMutex.Lock()
+		jobsMutex.Unlock()
+		jobsActive.Wait()
+		logInfo("Stopping the job API on "+flags.configListen, true)
+		server.Shutdown(context.Background())
+	}()
+	logInfo("Listening on "+flags.configListen, true)
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func serveAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := []byte("Bearer " + flags.configServeToken)
+		if flags.configServeToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+//-- GET /jobs lists jobs, POST /jobs submits one
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jobsMutex.Lock()
+		list := make([]jobStruct, 0, len(jobs))
+		for _, job := range jobs {
+			summary := *job
+			summary.Rows = nil
+			list = append(list, summary)
+		}
+		jobsMutex.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Submitted.Before(list[j].Submitted) })
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		job, err := submitJob(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+//-- GET /jobs/{id} returns a job with its row progress, DELETE /jobs/{id} or POST /jobs/{id}/cancel cancels it,
+//-- and GET /jobs/{id}/report downloads its report
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	jobsMutex.Lock()
+	job, ok := jobs[parts[0]]
+	jobsMutex.Unlock()
+	if !ok || len(parts) > 2 {
+		writeJSONError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, jobProgress(job))
+	case (action == "" && r.Method == http.MethodDelete) || (action == "cancel" && r.Method == http.MethodPost):
+		cancelJob(job)
+		writeJSON(w, http.StatusOK, jobProgress(job))
+	case action == "report" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+job.ID+"_report.csv\"")
+		jobsMutex.Lock()
+		running := currentJob == job.ID
+		jobsMutex.Unlock()
+		if running {
+			writeReportRows(w, reportSince(0))
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(flags.configServeDir, job.ID, "report.csv"))
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+//-- Create a job from a multipart upload of CSVs and files, or from a JSON body of server side paths
+func submitJob(r *http.Request) (*jobStruct, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	job := &jobStruct{ID: id, Status: jobQueued, Submitted: time.Now(), CSVs: make(map[string]string)}
+	jobDir := filepath.Join(flags.configServeDir, id)
+	err = os.MkdirAll(jobDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err = receiveJobFiles(r, job, jobDir)
+	} else {
+		err = receiveJobPaths(r, job)
+	}
+	if err == nil && job.CSVs["csvd"] == "" && job.Crawl == "" {
+		err = errors.New("a main CSV (csvd) or files to import are required")
+	}
+	if err != nil {
+		os.RemoveAll(jobDir)
+		return nil, err
+	}
+
+	submitted := *job
+	jobsMutex.Lock()
+	jobs[id] = job
+	jobsMutex.Unlock()
+	saveJobOrLog(job)
+	select {
+	case jobQueue <- id:
+	default:
+		jobsMutex.Lock()
+		job.Status, job.Error = jobFailed, "job queue is full"
+		jobsMutex.Unlock()
+		saveJobOrLog(job)
+		return nil, errors.New("job queue is full")
+	}
+	logInfo("Job "+id+" queued", true)
+	return &submitted, nil
+}
+
+//-- Save the uploaded CSV parts and files. A job without a main CSV imports every uploaded file, and
+//-- relative paths in the uploaded CSVs are taken to be the names of uploaded files
+func receiveJobFiles(r *http.Request, job *jobStruct, jobDir string) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	filesDir := filepath.Join(jobDir, "files")
+	fileCount := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := part.FormName()
+		destination := ""
+		switch {
+		case name == "files" && part.FileName() != "":
+			destination = filepath.Join(filesDir, filepath.Base(part.FileName()))
+			fileCount++
+		case containsString(jobCSVNames, name):
+			destination = filepath.Join(jobDir, name+".csv")
+			job.CSVs[name] = destination
+		default:
+			part.Close()
+			continue
+		}
+		err = saveJobPart(part, destination)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+	job.Root = filesDir
+	if fileCount > 0 && job.CSVs["csvd"] == "" {
+		job.Crawl = filesDir
+	}
+	return nil
+}
+
+func saveJobPart(src io.Reader, destination string) error {
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//-- Read the server side CSV and crawl paths of a job, which must be under -serveroot when it is set
+func receiveJobPaths(r *http.Request, job *jobStruct) error {
+	var request jobRequestStruct
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return err
+	}
+	job.Root = flags.configServeRoot
+	for name, value := range map[string]string{
+		"csvd": request.CSVD,
+		"csvs": request.CSVS,
+		"csvc": request.CSVC,
+		"csvt": request.CSVT,
+		"csva": request.CSVA,
+		"csvl": request.CSVL,
+	} {
+		if value == "" {
+			continue
+		}
+		if !jobPathAllowed(job.Root, value) {
+			return errors.New(name + " is outside the allowed folder: " + value)
+		}
+		job.CSVs[name] = value
+	}
+	if request.Crawl != "" && !jobPathAllowed(job.Root, request.Crawl) {
+		return errors.New("crawl is outside the allowed folder: " + request.Crawl)
+	}
+	job.Crawl = request.Crawl
+	return nil
+}
+
+func jobPathAllowed(root, filePath string) bool {
+	archivePath, _, _ := splitArchivePath(filePath)
+	rel, err := filepath.Rel(root, filepath.Clean(archivePath))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func cancelJob(job *jobStruct) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	switch job.Status {
+	case jobQueued:
+		job.Status = jobCancelled
+		now := time.Now()
+		job.Finished = &now
+		logInfo("Job "+job.ID+" cancelled", true)
+		if err := saveJob(job); err != nil {
+			logError("Error saving job "+job.ID+": "+err.Error(), true)
+		}
+	case jobRunning:
+		//-- Once runJob has returned there is nothing left to stop
+		if job.ended {
+			return
+		}
+		logInfo("Job "+job.ID+" cancelling, after the current document", true)
+		atomic.StoreInt32(&stopRun, 1)
+	}
+}
+
+func runJobs() {
+	for id := range jobQueue {
+		jobsMutex.Lock()
+		job := jobs[id]
+		if job == nil || job.Status != jobQueued || shutdownRequested() {
+			jobsMutex.Unlock()
+			continue
+		}
+		jobsActive.Add(1)
+		now := time.Now()
+		job.Status = jobRunning
+		job.Started = &now
+		currentJob = id
+		jobsMutex.Unlock()
+		saveJobOrLog(job)
+
+		logInfo("Job "+id+" started", true)
+		err := runJob(job)
+
+		jobsMutex.Lock()
+		finished := time.Now()
+		job.Finished = &finished
+		job.Rows = jobRows(job.paths, reportSince(0))
+		job.Processed, job.Imported, job.Failed = countJobRows(job.Rows)
+		switch {
+		case err != nil:
+			job.Status = jobFailed
+			job.Error = err.Error()
+		case shutdownRequested():
+			job.Status = jobInterrupted
+		case job.stopped:
+			job.Status = jobCancelled
+		default:
+			job.Status = jobCompleted
+		}
+		currentJob = ""
+		jobsMutex.Unlock()
+		atomic.StoreInt32(&stopRun, 0)
+
+		flags.configReport = filepath.Join(flags.configServeDir, id, "report.csv")
+		if err := writeReport(); err != nil {
+			logError("Error writing report "+flags.configReport+": "+err.Error(), true)
+		}
+		if err := saveIDMap(filepath.Join(flags.configServeDir, id, "idmap.json")); err != nil {
+			logError("Error writing ID map for job "+id+": "+err.Error(), true)
+		}
+		cleanupSessionFiles()
+		closeArchives()
+		saveJobOrLog(job)
+		logInfo("Job "+id+" "+job.Status, true)
+		jobsActive.Done()
+	}
+}
+
+//-- Run a job through the import pipeline, starting from a clean slate
+func runJob(job *jobStruct) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job stopped: %v", r)
+		}
+		jobsMutex.Lock()
+		job.ended = true
+		job.stopped = stopRequested()
+		jobsMutex.Unlock()
+	}()
+	resetRun()
+	flags.configCSVMain = job.CSVs["csvd"]
+	flags.configCSVShares = job.CSVs["csvs"]
+	flags.configCSVCollections = job.CSVs["csvc"]
+	flags.configCSVTags = job.CSVs["csvt"]
+	flags.configCSVComments = job.CSVs["csva"]
+	flags.configCSVLinks = job.CSVs["csvl"]
+	flags.configCrawl = job.Crawl
+
+	if job.Root != "" && job.Crawl == "" {
+		csvPathBase = job.Root + string(filepath.Separator)
+	}
+	if err := loadDocuments(); err != nil {
+		return err
+	}
+
+	var allowed []csvStruct
+	for _, file := range csvContent {
+		if !jobPathAllowed(job.Root, file.Filepath) {
+			logError("Job "+job.ID+": "+file.Filepath+" is outside the allowed folder", true)
+			addReport(file.Filepath, "", "job", "failed", "outside the allowed folder")
+			continue
+		}
+		allowed = append(allowed, file)
+	}
+	csvContent = allowed
+	jobsMutex.Lock()
+	for _, file := range csvContent {
+		job.paths = append(job.paths, file.Filepath)
+	}
+	job.Total = len(job.paths)
+	jobsMutex.Unlock()
+
+	if len(csvContent) == 0 {
+		return errors.New("no documents found to import")
+	}
+	processDocuments()
+	if len(csvLinks) > 0 && !stopRequested() {
+		processLinks()
+	}
+	return nil
+}
+
+//-- Clear the documents, results, counters, timings and metrics of the previous job
+func resetRun() {
+	csvContent = nil
+	csvShares = make(map[string][]sharesStruct)
+	csvCollections = make(map[string][]int)
+	csvTags = make(map[string][]string)
+	csvComments = make(map[string][]commentStruct)
+	csvLinks = nil
+	csvPathBase = ""
+	importedDocs = make(map[string]string)
+	counters = counterStruct{}
+	idMapMutex.Lock()
+	idMap = make(map[string]idMapStruct)
+	idMapMutex.Unlock()
+	reportMutex.Lock()
+	reportRows = nil
+	reportMutex.Unlock()
+	timingMutex.Lock()
+	stageTimings = make(map[string][]time.Duration)
+	stageCalls = make(map[string]int)
+	timingMutex.Unlock()
+	resetMetrics()
+}
+
+//-- The job with row progress worked out from the report, while it is running
+func jobProgress(job *jobStruct) jobStruct {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	progress := *job
+	if currentJob == job.ID {
+		progress.Rows = jobRows(job.paths, reportSince(0))
+		progress.Processed, progress.Imported, progress.Failed = countJobRows(progress.Rows)
+	}
+	return progress
+}
+
+func jobRows(paths []string, report []reportStruct) []jobRowStruct {
+	rows := make([]jobRowStruct, len(paths))
+	index := make(map[string]int)
+	for i, filePath := range paths {
+		rows[i] = jobRowStruct{Filepath: filePath, Status: "pending"}
+		index[filePath] = i
+	}
+	for _, line := range report {
+		i, ok := index[line.Filepath]
+		if !ok {
+			continue
+		}
+		row := &rows[i]
+		switch {
+		case line.Stage == "filter":
+			row.Status, row.Detail = "skipped", line.Detail
+		case line.Stage == "document" && line.Outcome == "success":
+			row.Status, row.DocumentID = "imported", line.DocumentID
+		case line.Outcome == "failed" && row.DocumentID != "":
+			row.Status, row.Detail = "partial", line.Stage+": "+line.Detail
+		case line.Outcome == "failed":
+			row.Status, row.Detail = "failed", line.Stage+": "+line.Detail
+		}
+	}
+	return rows
+}
+
+func countJobRows(rows []jobRowStruct) (processed, imported, failed int) {
+	for _, row := range rows {
+		switch row.Status {
+		case "pending":
+			continue
+		case "imported", "partial":
+			imported++
+		case "failed":
+			failed++
+		}
+		processed++
+	}
+	return processed, imported, failed
+}
+
+//-- Load the jobs of previous runs. Queued jobs are queued again, and jobs that were running are marked interrupted
+func loadJobs() error {
+	dirs, err := ioutil.ReadDir(flags.configServeDir)
+	if err != nil {
+		return err
+	}
+	var queued []*jobStruct
+	for _, dir := range dirs {
+		content, err := ioutil.ReadFile(filepath.Join(flags.configServeDir, dir.Name(), "job.json"))
+		if err != nil {
+			continue
+		}
+		job := &jobStruct{}
+		err = json.Unmarshal(content, job)
+		if err != nil {
+			logError("Error loading job "+dir.Name()+": "+err.Error(), true)
+			continue
+		}
+		switch job.Status {
+		case jobRunning:
+			job.Status = jobInterrupted
+			saveJobOrLog(job)
+		case jobQueued:
+			queued = append(queued, job)
+		}
+		jobs[job.ID] = job
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].Submitted.Before(queued[j].Submitted) })
+	for _, job := range queued {
+		jobQueue <- job.ID
+	}
+	logInfo(fmt.Sprintf("Loaded %d jobs, %d queued", len(jobs), len(queued)), true)
+	return nil
+}
+
+func saveJob(job *jobStruct) error {
+	content, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(flags.configServeDir, job.ID, "job.json"), content, 0644)
+}
+
+func saveJobOrLog(job *jobStruct) {
+	jobsMutex.Lock()
+	err := saveJob(job)
+	jobsMutex.Unlock()
+	if err != nil {
+		logError("Error saving job "+job.ID+": "+err.Error(), true)
+	}
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return time.Now().Format("20060102150405") + "-" + hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestJobPathAllowed(t *testing.T) {
+	root := "/srv/imports"
+	tests := []struct {
+		filePath string
+		want     bool
+	}{
+		{"/srv/imports/docs_main.csv", true},
+		{"/srv/imports/hr/policy.pdf", true},
+		{"/srv/imports", true},
+		{"/srv/imports/..hidden/policy.pdf", true},
+		{"/srv/imports/pack.zip!/policies/HR.pdf", true},
+		{"/srv/imports/pack.zip!/../../etc/passwd", true},
+		{"/srv/imports/../secrets.csv", false},
+		{"/srv/imports/hr/../../secrets.csv", false},
+		{"/srv/imports-old/docs_main.csv", false},
+		{"/srv/importsx/docs_main.csv", false},
+		{"/srv", false},
+		{"/etc/passwd", false},
+		{"/etc/pack.zip!/policies/HR.pdf", false},
+		{"/srv/imports/../../etc/pack.zip!/HR.pdf", false},
+		{"docs_main.csv", false},
+		{"../srv/imports/docs_main.csv", false},
+	}
+	for _, tt := range tests {
+		if got := jobPathAllowed(root, tt.filePath); got != tt.want {
+			t.Errorf("jobPathAllowed(%q, %q) = %v, want %v", root, tt.filePath, got, tt.want)
+		}
+	}
+}
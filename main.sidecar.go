@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//-- File suffixes of the metadata sidecars that can sit alongside each crawled document
+var sidecarSuffixes = []string{".metadata.json", ".metadata.properties.xml"}
+
+//-- Default mapping of sidecar property names to document fields, extended or replaced by -sidecarmap
+var sidecarMapping = map[string]string{
+	"title":          "Title",
+	"description":    "Description",
+	"status":         "Status",
+	"reviewdate":     "ReviewDate",
+	"owner":          "Owner",
+	"tags":           "Tags",
+	"collections":    "Collections",
+	"shares":         "Shares",
+	"cm:title":       "Title",
+	"cm:description": "Description",
+	"cm:owner":       "Owner",
+	"cm:taggable":    "Tags",
+}
+
+type sidecarPropertiesStruct struct {
+	Entries []struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"entry"`
+}
+
+type sidecarShareStruct struct {
+	URN            string `json:"urn"`
+	Read           bool   `json:"read"`
+	ModifyContent  bool   `json:"modifyContent"`
+	ModifyMetaData bool   `json:"modifyMetaData"`
+}
+
+//-- Load the sidecar property name mapping from a JSON file
+func loadSidecarMapping(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	mapping := make(map[string]string)
+	err = json.Unmarshal(content, &mapping)
+	if err != nil {
+		return err
+	}
+	for property, field := range mapping {
+		sidecarMapping[strings.ToLower(property)] = field
+	}
+	return nil
+}
+
+func isSidecar(filePath string) bool {
+	lower := strings.ToLower(filePath)
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+//-- Apply the metadata from any sidecar files found next to a document
+func applySidecars(file *csvStruct) {
+	for _, suffix := range sidecarSuffixes {
+		sidecarPath := file.Filepath + suffix
+		if _, _, err := statSource(sidecarPath); err != nil {
+			continue
+		}
+		logDebug("Loading sidecar: "+sidecarPath, false)
+		properties, err := readSidecar(sidecarPath)
+		if err == nil {
+			err = applySidecarProperties(file, properties)
+		}
+		if err != nil {
+			logError("Error loading sidecar "+sidecarPath+": "+err.Error(), true)
+			addReport(file.Filepath, "", "sidecar", "failed", sidecarPath+": "+err.Error())
+			continue
+		}
+		addReport(file.Filepath, "", "sidecar", "success", sidecarPath)
+	}
+}
+
+func readSidecar(sidecarPath string) (map[string]interface{}, error) {
+	src, _, err := openSource(sidecarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	content, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	properties := make(map[string]interface{})
+	if strings.HasSuffix(strings.ToLower(sidecarPath), ".json") {
+		err = json.Unmarshal(content, &properties)
+		return properties, err
+	}
+	var xmlProperties sidecarPropertiesStruct
+	err = xml.Unmarshal(content, &xmlProperties)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range xmlProperties.Entries {
+		properties[entry.Key] = strings.TrimSpace(entry.Value)
+	}
+	return properties, nil
+}
+
+//-- Apply sidecar properties in name order, once they have all been checked, so a bad property leaves the
+//-- document untouched rather than partly updated
+func applySidecarProperties(file *csvStruct, properties map[string]interface{}) error {
+	var names []string
+	for property := range properties {
+		names = append(names, property)
+	}
+	sort.Strings(names)
+
+	var apply []func()
+	for _, property := range names {
+		value := properties[property]
+		field, ok := sidecarMapping[strings.ToLower(property)]
+		if !ok {
+			logDebug("Sidecar property not mapped: "+property, false)
+			continue
+		}
+		switch field {
+		case "Title":
+			apply = append(apply, func() { file.Title = sidecarString(value) })
+		case "Description":
+			apply = append(apply, func() { file.Description = sidecarString(value) })
+		case "Status":
+			apply = append(apply, func() { file.Status = sidecarString(value) })
+		case "ReviewDate":
+			apply = append(apply, func() { file.ReviewDate = sidecarString(value) })
+		case "Owner":
+			apply = append(apply, func() { file.Owner = sidecarString(value) })
+		case "Tags":
+			tags := sidecarList(value)
+			apply = append(apply, func() { csvTags[file.Filepath] = append(csvTags[file.Filepath], tags...) })
+		case "Collections":
+			var collections []int
+			for _, collection := range sidecarList(value) {
+				collID, err := strconv.Atoi(collection)
+				if err != nil {
+					return errors.New("invalid collection ID " + collection)
+				}
+				collections = append(collections, collID)
+			}
+			apply = append(apply, func() { csvCollections[file.Filepath] = append(csvCollections[file.Filepath], collections...) })
+		case "Shares":
+			shares, err := sidecarShares(value)
+			if err != nil {
+				return err
+			}
+			apply = append(apply, func() { csvShares[file.Filepath] = append(csvShares[file.Filepath], shares...) })
+		default:
+			return errors.New("property " + property + " mapped to unknown field " + field)
+		}
+	}
+	for _, f := range apply {
+		f()
+	}
+	return nil
+}
+
+func sidecarString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case nil:
+		return ""
+	case []interface{}:
+		return strings.Join(sidecarList(v), ",")
+	}
+	return fmt.Sprint(value)
+}
+
+//-- Sidecar lists are either JSON arrays or comma separated strings
+func sidecarList(value interface{}) []string {
+	var list []string
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s := sidecarString(item); s != "" {
+				list = append(list, s)
+			}
+		}
+	default:
+		for _, item := range strings.Split(sidecarString(v), ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+//-- Shares are either URNs, which are given read access, or objects matching the shares CSV columns
+func sidecarShares(value interface{}) ([]sharesStruct, error) {
+	var shares []sharesStruct
+	items, ok := value.([]interface{})
+	if !ok {
+		for _, urn := range sidecarList(value) {
+			shares = append(shares, sharesStruct{URN: urn, Read: true})
+		}
+		return shares, nil
+	}
+	for _, item := range items {
+		if urn, ok := item.(string); ok {
+			shares = append(shares, sharesStruct{URN: urn, Read: true})
+			continue
+		}
+		itemJSON, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		var share sidecarShareStruct
+		err = json.Unmarshal(itemJSON, &share)
+		if err != nil {
+			return nil, errors.New("invalid share: " + err.Error())
+		}
+		if share.URN == "" {
+			return nil, errors.New("share without urn")
+		}
+		shares = append(shares, sharesStruct{
+			URN:            share.URN,
+			Read:           share.Read,
+			ModifyContent:  share.ModifyContent,
+			ModifyMetaData: share.ModifyMetaData,
+		})
+	}
+	return shares, nil
+}
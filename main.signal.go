@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	stopRun      int32 // set to stop the current run or serve job after the documents in progress
+	shuttingDown int32 // set by the first SIGINT or SIGTERM, or stop in -controlfile
+	paused       int32
+	shutdown     = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+//-- Files uploaded to the session and not yet deleted from it, so a forced quit can clean them up
+var (
+	sessionFiles      = make(map[string]csvStruct)
+	sessionFilesMutex sync.Mutex
+)
+
+//-- Set when the run should stop taking new rows
+func stopRequested() bool {
+	return atomic.LoadInt32(&stopRun) == 1 || shutdownRequested()
+}
+
+func shutdownRequested() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+//-- Stop taking new rows, letting the documents in progress finish all their stages
+func requestShutdown(reason string) {
+	shutdownOnce.Do(func() {
+		logInfo(reason+", stopping after the documents in progress. Send again to quit immediately", true)
+		atomic.StoreInt32(&shuttingDown, 1)
+		atomic.StoreInt32(&paused, 0)
+		close(shutdown)
+	})
+}
+
+func setPaused(pause bool, reason string) {
+	if pause && atomic.CompareAndSwapInt32(&paused, 0, 1) {
+		logInfo(reason+", pausing before the next document", true)
+	} else if !pause && atomic.CompareAndSwapInt32(&paused, 1, 0) {
+		logInfo(reason+", resuming", true)
+	}
+}
+
+//-- Handle SIGINT and SIGTERM, then SIGUSR1 and SIGUSR2 to pause and resume where the platform has them,
+//-- and poll -controlfile for pause, resume and stop
+func handleSignals() {
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	if pauseSignal != nil {
+		signals = append(signals, pauseSignal, resumeSignal)
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		for sig := range ch {
+			switch sig {
+			case pauseSignal:
+				setPaused(true, "Received "+sig.String())
+			case resumeSignal:
+				setPaused(false, "Received "+sig.String())
+			default:
+				if shutdownRequested() {
+					forceQuit("Received " + sig.String() + " again")
+				}
+				requestShutdown("Received " + sig.String())
+			}
+		}
+	}()
+	if flags.configControlFile != "" {
+		pollControlFile(flags.configControlFile)
+	}
+}
+
+//-- Act on the word in the control file each time it changes: pause, resume or stop. The first check is made
+//-- straight away, so a run can be started paused
+func pollControlFile(filename string) {
+	last := checkControlFile(filename, "")
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			last = checkControlFile(filename, last)
+		}
+	}()
+}
+
+func checkControlFile(filename, last string) string {
+	content, _ := ioutil.ReadFile(filename)
+	command := strings.ToLower(strings.TrimSpace(string(content)))
+	if command == last {
+		return last
+	}
+	switch command {
+	case "pause":
+		setPaused(true, filename+" says pause")
+	case "resume", "":
+		setPaused(false, filename+" says resume")
+	case "stop":
+		requestShutdown(filename + " says stop")
+	default:
+		logError("Unknown command in "+filename+": "+command+", expected pause, resume or stop", true)
+	}
+	return command
+}
+
+//-- Quit without waiting for the documents in progress, cleaning up the session and writing what we have
+func forceQuit(reason string) {
+	logError(reason+", quitting now. Documents in progress may be left partly configured", true)
+	cleanupSessionFiles()
+	closeArchives()
+	if err := writeReport(); err != nil {
+		logError("Error writing report "+flags.configReport+": "+err.Error(), true)
+	}
+	if flags.configMode != "export" && flags.configMode != "serve" {
+		if err := saveIDMap(flags.configIDMap); err != nil {
+			logError("Error writing ID map "+flags.configIDMap+": "+err.Error(), true)
+		}
+	}
+	os.Exit(exitPartial)
+}
+
+//-- Hold the run while paused, and outside -window, before starting on the next document
+func waitToContinue() {
+	if atomic.LoadInt32(&paused) == 1 {
+		logInfo("Paused, send SIGUSR2 or write resume to -controlfile to continue", true)
+		for atomic.LoadInt32(&paused) == 1 && !stopRequested() {
+			time.Sleep(time.Second)
+		}
+	}
+	waitForWindow()
+}
+
+func trackSessionFile(file *csvStruct) {
+	sessionFilesMutex.Lock()
+	defer sessionFilesMutex.Unlock()
+	sessionFiles[file.SessionPath] = *file
+}
+
+func untrackSessionFile(file *csvStruct) {
+	sessionFilesMutex.Lock()
+	defer sessionFilesMutex.Unlock()
+	delete(sessionFiles, file.SessionPath)
+}
+
+//-- Delete any files left in the session by documents that did not finish
+func cleanupSessionFiles() {
+	sessionFilesMutex.Lock()
+	var files []csvStruct
+	for _, file := range sessionFiles {
+		files = append(files, file)
+	}
+	sessionFilesMutex.Unlock()
+	for _, file := range files {
+		logInfo("Cleaning up session file "+file.SessionPath, true)
+		if err := deleteFileFromSession(&file); err != nil {
+			logError("Error deleting session file "+file.SessionPath+": "+err.Error(), true)
+		}
+	}
+}
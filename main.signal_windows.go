@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+//-- Windows has no SIGUSR1 or SIGUSR2, so runs are paused and resumed with -controlfile instead
+var (
+	pauseSignal  os.Signal
+	resumeSignal os.Signal
+)
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//-- Most recent timings kept for each stage, so a long-running watch or serve does not grow without bound
+const timingSampleLimit = 10000
+
+var (
+	stageTimings = make(map[string][]time.Duration)
+	stageCalls   = make(map[string]int)
+	timingMutex  sync.Mutex
+)
+
+//-- A named counter, for the final statistics
+type statStruct struct {
+	Name  string
+	Value uint64
+}
+
+//-- Record how long a processing stage took for a file
+func recordTiming(stage string, start time.Time) {
+	timingMutex.Lock()
+	defer timingMutex.Unlock()
+	timings := stageTimings[stage]
+	if len(timings) >= timingSampleLimit {
+		timings = append(timings[:0], timings[len(timings)-timingSampleLimit/2:]...)
+	}
+	stageTimings[stage] = append(timings, time.Since(start))
+	stageCalls[stage]++
+}
+
+//-- Minimum, average and 95th percentile of a set of timings
+func timingStats(durations []time.Duration) (time.Duration, time.Duration, time.Duration) {
+	if len(durations) == 0 {
+		return 0, 0, 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	p95 := sorted[(len(sorted)*95+99)/100-1]
+	return sorted[0], total / time.Duration(len(sorted)), p95
+}
+
+func counterStats() []statStruct {
+	return []statStruct{
+		{"session.addSuccess", counters.session.addSuccess},
+		{"session.addFailed", counters.session.addFailed},
+		{"session.deleteSuccess", counters.session.deleteSuccess},
+		{"session.deleteFailed", counters.session.deleteFailed},
+		{"session.bytes", counters.session.bytes},
+		{"documents.addSuccess", counters.documents.addSuccess},
+		{"documents.addFailed", counters.documents.addFailed},
+		{"documents.skipped", counters.documents.skipped},
+		{"owners.addSuccess", counters.owners.addSuccess},
+		{"owners.addFailed", counters.owners.addFailed},
+		{"collections.addSuccess", counters.collections.addSuccess},
+		{"collections.addFailed", counters.collections.addFailed},
+		{"shares.addSuccess", counters.shares.addSuccess},
+		{"shares.addFailed", counters.shares.addFailed},
+		{"tags.addSuccess", counters.tags.addSuccess},
+		{"tags.addFailed", counters.tags.addFailed},
+		{"tags.created", counters.tags.created},
+		{"tags.reused", counters.tags.reused},
+		{"comments.addSuccess", counters.comments.addSuccess},
+		{"comments.addFailed", counters.comments.addFailed},
+		{"links.addSuccess", counters.links.addSuccess},
+		{"links.addFailed", counters.links.addFailed},
+		{"exports.success", counters.exports.success},
+		{"exports.failed", counters.exports.failed},
+		{"updates.changed", counters.updates.changed},
+		{"updates.unchanged", counters.updates.unchanged},
+		{"updates.metadata", counters.updates.metadata},
+		{"updates.revisions", counters.updates.revisions},
+		{"updates.removed", counters.updates.removed},
+		{"updates.failed", counters.updates.failed},
+	}
+}
+
+func timedStages() []string {
+	var stages []string
+	for stage := range stageTimings {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	return stages
+}
+
+//-- Output the bytes uploaded and the timings of each stage
+func printStats() {
+	logInfo("🟢 Bytes uploaded to Hornbill Session: "+formatBytes(counters.session.bytes), true)
+	timingMutex.Lock()
+	defer timingMutex.Unlock()
+	for _, stage := range timedStages() {
+		min, avg, p95 := timingStats(stageTimings[stage])
+		logInfo(fmt.Sprintf("⏱  %-12s %6d calls, min %v, avg %v, p95 %v", stage, stageCalls[stage],
+			min.Round(time.Millisecond), avg.Round(time.Millisecond), p95.Round(time.Millisecond)), true)
+	}
+}
+
+//-- The counters and stage timings as report rows, written after the rows for each file
+func statsReportRows() []reportStruct {
+	var rows []reportStruct
+	for _, stat := range counterStats() {
+		rows = append(rows, reportStruct{Stage: "stats", Outcome: stat.Name, Detail: fmt.Sprint(stat.Value)})
+	}
+	timingMutex.Lock()
+	defer timingMutex.Unlock()
+	for _, stage := range timedStages() {
+		min, avg, p95 := timingStats(stageTimings[stage])
+		rows = append(rows, reportStruct{
+			Stage:   "timing",
+			Outcome: stage,
+			Detail:  fmt.Sprintf("calls=%d min=%v avg=%v p95=%v", stageCalls[stage], min, avg, p95),
+		})
+	}
+	return rows
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"os"
+	"strconv"
+	"time"
+
 	apiLib "github.com/hornbill/goApiLib"
 	logrus "github.com/sirupsen/logrus"
 )
@@ -10,55 +14,168 @@ const (
 	logPrefix = "docimport"
 )
 
+var (
+	logPath string
+	runTime = time.Now().Format("20060102150405")
+	runID   = runTime + "-" + strconv.Itoa(os.Getpid())
+)
+
 var (
 	counters       counterStruct
 	csvContent     []csvStruct
 	csvShares      = make(map[string][]sharesStruct)
 	csvCollections = make(map[string][]int)
 	csvTags        = make(map[string][]string)
+	csvComments    = make(map[string][]commentStruct)
+	csvLinks       []linkStruct
+	importedDocs   = make(map[string]string)
+	exportedDocs   = make(map[string]string)
+	csvPathBase    string
 	espXmlmc       *apiLib.XmlmcInstStruct
 	flags          flagsStruct
 	logFile        = logrus.New()
 	logStdOut      = logrus.New()
 	foundTags      = make(map[string]int)
+	mimeOverrides  = make(map[string]string)
 )
 
 type counterStruct struct {
 	session struct {
-		addSuccess    uint16
-		addFailed     uint16
-		deleteSuccess uint16
-		deleteFailed  uint16
+		addSuccess    uint64
+		addFailed     uint64
+		deleteSuccess uint64
+		deleteFailed  uint64
+		bytes         uint64
 	}
 	documents struct {
-		addSuccess uint16
-		addFailed  uint16
+		addSuccess uint64
+		addFailed  uint64
+		skipped    uint64
+	}
+	owners struct {
+		addSuccess uint64
+		addFailed  uint64
 	}
 	collections struct {
-		addSuccess uint16
-		addFailed  uint16
+		addSuccess uint64
+		addFailed  uint64
 	}
 	shares struct {
-		addSuccess uint16
-		addFailed  uint16
+		addSuccess uint64
+		addFailed  uint64
 	}
 	tags struct {
-		addSuccess uint16
-		addFailed  uint16
+		addSuccess uint64
+		addFailed  uint64
+		created    uint64
+		reused     uint64
+	}
+	comments struct {
+		addSuccess uint64
+		addFailed  uint64
+	}
+	links struct {
+		addSuccess uint64
+		addFailed  uint64
+	}
+	exports struct {
+		success uint64
+		failed  uint64
+	}
+	updates struct {
+		changed   uint64
+		unchanged uint64
+		metadata  uint64
+		revisions uint64
+		removed   uint64
+		failed    uint64
 	}
 }
 
 type flagsStruct struct {
-	configAPIKey         string
-	configAPITimeout     int
-	configCSVMain        string
-	configCSVShares      string
-	configCSVCollections string
-	configCSVTags        string
-	configDebug          bool
-	configDryRun         bool
-	configInstanceID     string
-	configVersion        bool
+	configAPIKey           string
+	configTagPrefetch      bool
+	configTagMatch         string
+	configAPITimeout       int
+	configProxy            string
+	configNoProxy          string
+	configCACert           string
+	configClientCert       string
+	configClientKey        string
+	configRateReads        float64
+	configRateWrites       float64
+	configRateBytes        string
+	configControlFile      string
+	configWindow           string
+	configCSVMain          string
+	configCSVShares        string
+	configCSVCollections   string
+	configCSVComments      string
+	configCSVLinks         string
+	configCSVTags          string
+	configCollectionMap    string
+	configCrawl            string
+	configCrawlStatus      string
+	configDebug            bool
+	configDiffContent      bool
+	configDiffReport       string
+	configDryRun           bool
+	configSkipCheck        bool
+	configCheckWrites      bool
+	configExcludeExt       string
+	configExcludeRegex     string
+	configExportCollection int
+	configExportDir        string
+	configExportTag        string
+	configExtractMeta      bool
+	configFailThreshold    int
+	configFieldSchema      string
+	configIncludeExt       string
+	configImportedFrom     string
+	configIDMap            string
+	configIncludeRegex     string
+	configInstanceID       string
+	configJUnit            string
+	configKeywordTags      bool
+	configLogDir           string
+	configLogFile          string
+	configLogFormat        string
+	configLogLevel         string
+	configMaxSize          string
+	configMetricsFile      string
+	configMetricsListen    string
+	configMigrateDir       string
+	configMigrateMap       string
+	configMimeMap          string
+	configMinSize          string
+	configMode             string
+	configModifiedAfter    string
+	configModifiedBefore   string
+	configProgress         string
+	configProgressInterval int
+	configPrevious         string
+	configReport           string
+	configRetries          int
+	configRetryDelay       int
+	configSourceAPIKey     string
+	configSourceInstanceID string
+	configSyncCollection   int
+	configSyncDelete       string
+	configSyncMaxDelete    int
+	configSyncState        string
+	configWatch            string
+	configWatchDefaults    string
+	configWatchInterval    int
+	configWatchSettle      int
+	configWatchState       string
+	configListen           string
+	configServeDir         string
+	configServeRoot        string
+	configServeToken       string
+	configUserMap          string
+	configSidecarMap       string
+	configSidecars         bool
+	configVersion          bool
 }
 
 type csvStruct struct {
@@ -72,9 +189,11 @@ type csvStruct struct {
 	Shares            []sharesStruct
 	Owner             string
 	Tags              string
+	CustomFields      []customFieldStruct
 	Filename          string
 	SessionPath       string
 	ContentType       string
+	ContentHash       string
 	DocumentID        string
 	ActivityStreamID  string
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-- What sync last saw of a source file, so unchanged files can be skipped without hashing them
+type syncStateStruct struct {
+	DocumentID string    `json:"documentId"`
+	Hash       string    `json:"hash"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+}
+
+func loadSyncState(filename string) (map[string]syncStateStruct, error) {
+	state := make(map[string]syncStateStruct)
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &state)
+	return state, err
+}
+
+func saveSyncState(filename string, state map[string]syncStateStruct) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+//-- Make the -synccollection collection mirror the crawled files: add new files, revise changed ones,
+//-- and optionally archive or remove the documents of files that have gone
+func syncDocuments() error {
+	collectionID := flags.configSyncCollection
+	state, err := loadSyncState(flags.configSyncState)
+	if err != nil {
+		return errors.New("error loading sync state " + flags.configSyncState + ": " + err.Error())
+	}
+	docIDs, err := getLibraryDocumentIDs(targetInstance(), collectionID, "")
+	if err != nil {
+		return err
+	}
+	inCollection := make(map[string]bool)
+	for _, docID := range docIDs {
+		inCollection[docID] = true
+	}
+	logInfo("Syncing "+strconv.Itoa(len(csvContent))+" files with "+strconv.Itoa(len(docIDs))+" documents in collection "+strconv.Itoa(collectionID), true)
+
+	var newDocs []csvStruct
+	present := make(map[string]bool)
+	for i, file := range csvContent {
+		waitToContinue()
+		if stopRequested() {
+			logInfo("Stopping, "+strconv.Itoa(len(csvContent)-i)+" files not processed", true)
+			break
+		}
+		setLogDocument(i+1, file.Filepath)
+		//A filtered file is still on disk, so its document is left alone rather than treated as gone
+		present[file.Filepath] = true
+		if rule := fileExcluded(file.Filepath); rule != "" {
+			logInfo("Skipping: "+file.Filepath+" - "+rule, true)
+			addReport(file.Filepath, "", "filter", "skipped", rule)
+			counters.documents.skipped++
+			continue
+		}
+		prev, ok := state[file.Filepath]
+		if ok && !inCollection[prev.DocumentID] {
+			//Taken out of the collection on the instance, so put it back rather than import a duplicate,
+			//unless the document itself has gone
+			err := syncReAdd(prev.DocumentID, collectionID)
+			switch {
+			case err == nil:
+				inCollection[prev.DocumentID] = true
+				addReport(file.Filepath, prev.DocumentID, "sync", "re-added", "document was no longer in collection "+strconv.Itoa(collectionID))
+			case err == errDocumentGone:
+				logInfo("Document "+prev.DocumentID+" no longer exists, importing "+file.Filepath+" again", true)
+				ok = false
+			default:
+				counters.updates.failed++
+				logError(err.Error(), true)
+				addReport(file.Filepath, prev.DocumentID, "sync", "failed", "re-add to collection: "+err.Error())
+				continue
+			}
+		}
+		if !ok {
+			if !containsInt(csvCollections[file.Filepath], collectionID) {
+				csvCollections[file.Filepath] = append(csvCollections[file.Filepath], collectionID)
+			}
+			newDocs = append(newDocs, file)
+			continue
+		}
+
+		setLogDocumentID(prev.DocumentID)
+		current := prev
+		info, statErr := os.Stat(file.Filepath)
+		if statErr == nil && info.Size() == prev.Size && info.ModTime().Equal(prev.ModTime) {
+			counters.updates.unchanged++
+			continue
+		}
+		hash, err := hashSource(file.Filepath)
+		if err != nil {
+			counters.updates.failed++
+			logError(err.Error(), true)
+			addReport(file.Filepath, prev.DocumentID, "sync", "failed", err.Error())
+			continue
+		}
+		if hash != prev.Hash {
+			logInfo("Revising: "+file.Filepath, true)
+			prepareFile(&file)
+			file.DocumentID = prev.DocumentID
+			err = documentRevise(&file)
+			if err != nil {
+				counters.updates.failed++
+				logError(err.Error(), true)
+				addReport(file.Filepath, prev.DocumentID, "sync", "failed", "revise: "+err.Error())
+				continue
+			}
+			counters.updates.revisions++
+			addReport(file.Filepath, prev.DocumentID, "sync", "revised", "")
+			current.Hash = hash
+		} else {
+			counters.updates.unchanged++
+		}
+		if statErr == nil {
+			current.Size, current.ModTime = info.Size(), info.ModTime()
+		}
+		state[file.Filepath] = current
+	}
+	setLogDocument(0, "")
+
+	//Import new files, which are added to the collection along with any collections from the CSVs
+	csvContent = newDocs
+	if len(csvContent) > 0 {
+		processDocuments()
+	}
+	for _, file := range newDocs {
+		docID, ok := importedDocs[file.Filepath]
+		if !ok || docID == "" {
+			continue
+		}
+		entry := syncStateStruct{DocumentID: docID, Hash: idMap[file.Filepath].Hash}
+		if info, err := os.Stat(file.Filepath); err == nil {
+			entry.Size, entry.ModTime = info.Size(), info.ModTime()
+		}
+		state[file.Filepath] = entry
+	}
+
+	//The files not reached before a stop would look like they had gone
+	if stopRequested() {
+		logInfo("Run stopped, not checking for removed files", true)
+	} else {
+		syncRemoved(state, present, inCollection)
+	}
+	if flags.configDryRun {
+		return nil
+	}
+	return saveSyncState(flags.configSyncState, state)
+}
+
+var errDocumentGone = errors.New("document no longer exists")
+
+//-- Add a synced document back in to the collection. Returns errDocumentGone when that fails because the
+//-- instance answers that the document does not exist, and any other error as it is
+func syncReAdd(docID string, collectionID int) error {
+	logInfo("Adding document "+docID+" back in to collection "+strconv.Itoa(collectionID), true)
+	err := addToCollection(docID, collectionID)
+	if err == nil {
+		return nil
+	}
+	espXmlmc.SetParam("documentId", docID)
+	infoErr := invokeXMLMC("library", "documentGetInfo", nil)
+	if isNotFoundError(infoErr) {
+		return errDocumentGone
+	}
+	if infoErr != nil {
+		return infoErr
+	}
+	return err
+}
+
+//-- Whether the instance answered that the record asked for does not exist. Failed connections, HTTP
+//-- errors and other method failures say nothing about whether it is there
+func isNotFoundError(err error) bool {
+	methodErr, ok := err.(*xmlmcError)
+	if !ok {
+		return false
+	}
+	message := strings.ToLower(methodErr.message)
+	return strings.Contains(message, "not found") || strings.Contains(message, "does not exist")
+}
+
+//-- Archive or remove the documents whose source files have gone, unless too many would be affected
+func syncRemoved(state map[string]syncStateStruct, present, inCollection map[string]bool) {
+	var gone []string
+	for filePath, entry := range state {
+		if !present[filePath] && inCollection[entry.DocumentID] {
+			gone = append(gone, filePath)
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+	sort.Strings(gone)
+	for _, filePath := range gone {
+		logInfo("Source file gone: "+filePath, true)
+	}
+	if flags.configSyncDelete == "none" {
+		for _, filePath := range gone {
+			addReport(filePath, state[filePath].DocumentID, "sync", "source gone", "left in place, -syncdelete none")
+		}
+		return
+	}
+	percent := len(gone) * 100 / len(state)
+	if percent > flags.configSyncMaxDelete {
+		logError("Refusing to "+flags.configSyncDelete+" "+strconv.Itoa(len(gone))+" of "+strconv.Itoa(len(state))+
+			" synced documents ("+strconv.Itoa(percent)+"%), above -syncmaxdelete "+strconv.Itoa(flags.configSyncMaxDelete)+"%", true)
+		for _, filePath := range gone {
+			addReport(filePath, state[filePath].DocumentID, "sync", "source gone", "not "+flags.configSyncDelete+"d, above -syncmaxdelete")
+		}
+		return
+	}
+
+	for _, filePath := range gone {
+		docID := state[filePath].DocumentID
+		var err error
+		if flags.configSyncDelete == "archive" {
+			err = documentUpdateFields(docID, []customFieldStruct{{Field: "status", Value: "archived"}})
+		} else {
+			err = documentDelete(docID)
+		}
+		if err != nil {
+			counters.updates.failed++
+			logError(err.Error(), true)
+			addReport(filePath, docID, "sync", "failed", flags.configSyncDelete+": "+err.Error())
+			continue
+		}
+		counters.updates.removed++
+		addReport(filePath, docID, "sync", flags.configSyncDelete+"d", "source file gone")
+		delete(state, filePath)
+	}
+}
+
+func documentDelete(documentID string) error {
+	logInfo("Deleting Document "+documentID, false)
+	espXmlmc.SetParam("documentId", documentID)
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("library", "documentDelete", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Document Deleted Successfully", false)
+	} else {
+		logInfo("[DRYRUN] library::documentDelete:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
+
+func containsInt(list []int, value int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//-- Number of tags to request per tagGetList call when prefetching
+const tagPageSize = 500
+
+//-- The key a tag name is matched and cached by, for -tagmatch
+func tagKey(name string) string {
+	switch flags.configTagMatch {
+	case "exact":
+		return name
+	case "normalized":
+		return normalizeTag(name)
+	default:
+		return strings.ToLower(name)
+	}
+}
+
+//-- Lower case, with whitespace trimmed and collapsed, invisible formatting characters removed, full width
+//-- forms folded to ASCII and typographic dashes and quotes folded to their plain equivalents
+func normalizeTag(name string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range name {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case unicode.Is(unicode.Cf, r):
+			continue
+		case r >= 0xFF01 && r <= 0xFF5E:
+			r -= 0xFEE0
+		case r >= 0x2010 && r <= 0x2015, r == 0x2212:
+			r = '-'
+		case r >= 0x2018 && r <= 0x201B:
+			r = '\''
+		case r >= 0x201C && r <= 0x201F:
+			r = '"'
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+//-- Load every tag in the library tag group in to the tag cache, a page at a time, so each existing tag in the
+//-- CSVs no longer needs its own tagGetList call. Where -tagmatch treats several tags as the same, the
+//-- oldest is used
+func prefetchTags() error {
+	logInfo("Loading library tags", true)
+	var tags []tagsStruct
+	seen := make(map[int]bool)
+	for rowStart := 0; ; rowStart += tagPageSize {
+		espXmlmc.SetParam("tagGroup", "urn:tagGroup:library")
+		espXmlmc.SetParam("rowStart", strconv.Itoa(rowStart))
+		espXmlmc.SetParam("limit", strconv.Itoa(tagPageSize))
+		var xmlmcResponse xmlmcResponseStruct
+		err := invokeXMLMC("library", "tagGetList", &xmlmcResponse)
+		if err != nil {
+			return err
+		}
+		added := 0
+		for _, tag := range xmlmcResponse.TagsFound {
+			if !seen[tag.ID] {
+				seen[tag.ID] = true
+				tags = append(tags, tag)
+				added++
+			}
+		}
+		//Stop on a short page, or a repeated one in case paging is not honoured
+		if len(xmlmcResponse.TagsFound) < tagPageSize || added == 0 {
+			break
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+
+	foundTags = make(map[string]int)
+	for _, tag := range tags {
+		key := tagKey(tag.Name)
+		if _, ok := foundTags[key]; !ok {
+			foundTags[key] = tag.ID
+		}
+	}
+	logInfo(fmt.Sprintf("Loaded %d library tags", len(tags)), true)
+	reportNearDuplicateTags(tags)
+	return nil
+}
+
+//-- Log and report the groups of existing tags that only differ by case, spacing or punctuation style,
+//-- and which tag -tagmatch uses where it cannot tell them apart
+func reportNearDuplicateTags(tags []tagsStruct) {
+	groups := make(map[string][]tagsStruct)
+	var keys []string
+	for _, tag := range tags {
+		key := normalizeTag(tag.Name)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], tag)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		group := groups[key]
+		if len(group) < 2 {
+			continue
+		}
+		var names []string
+		for _, tag := range group {
+			names = append(names, strconv.Quote(tag.Name)+" ("+strconv.Itoa(tag.ID)+")")
+		}
+		detail := strings.Join(names, ", ")
+		matched := make(map[string][]string)
+		var matchedKeys []string
+		for _, tag := range group {
+			key := tagKey(tag.Name)
+			if _, ok := matched[key]; !ok {
+				matchedKeys = append(matchedKeys, key)
+			}
+			matched[key] = append(matched[key], strconv.Quote(tag.Name))
+		}
+		for _, key := range matchedKeys {
+			if len(matched[key]) > 1 {
+				detail += "; -tagmatch " + flags.configTagMatch + " cannot tell " + strings.Join(matched[key], " and ") +
+					" apart and uses " + strconv.Itoa(foundTags[key])
+			}
+		}
+		logInfo("Near-duplicate tags: "+detail, true)
+		addReport("", "", "tags", "near-duplicate", detail)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Policy", "policy"},
+		{"  Human   Resources ", "human resources"},
+		{"Human\tResources", "human resources"},
+		{"Ｐｏｌｉｃｙ", "policy"},
+		{"Health–and—Safety", "health-and-safety"},
+		{"“Quoted” ‘tag’", "\"quoted\" 'tag'"},
+		{"zero\u200bwidth", "zerowidth"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeTag(tt.name); got != tt.want {
+			t.Errorf("normalizeTag(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTagKey(t *testing.T) {
+	defer func(match string) { flags.configTagMatch = match }(flags.configTagMatch)
+	tests := []struct {
+		match string
+		name  string
+		want  string
+	}{
+		{"exact", " Policy ", " Policy "},
+		{"insensitive", " Policy ", " policy "},
+		{"normalized", " Policy ", "policy"},
+	}
+	for _, tt := range tests {
+		flags.configTagMatch = tt.match
+		if got := tagKey(tt.name); got != tt.want {
+			t.Errorf("tagKey(%q) with -tagmatch %s = %q, want %q", tt.name, tt.match, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//-- Bring documents imported by a previous run in line with the current CSVs, and import any new rows
+func updateDocuments(previous map[string]idMapStruct) {
+	logInfo("Comparing "+strconv.Itoa(len(csvContent))+" files with "+strconv.Itoa(len(previous))+" previously imported documents", true)
+	var newDocs []csvStruct
+	seen := make(map[string]bool)
+	for i, file := range csvContent {
+		waitToContinue()
+		if stopRequested() {
+			logInfo("Stopping, "+strconv.Itoa(len(csvContent)-i)+" files not processed", true)
+			break
+		}
+		setLogDocument(i+1, file.Filepath)
+		if rule := fileExcluded(file.Filepath); rule != "" {
+			logInfo("Skipping: "+file.Filepath+" - "+rule, true)
+			addReport(file.Filepath, "", "filter", "skipped", rule)
+			counters.documents.skipped++
+			continue
+		}
+		prev, ok := previous[file.Filepath]
+		if !ok {
+			newDocs = append(newDocs, file)
+			continue
+		}
+		seen[file.Filepath] = true
+		setLogDocumentID(prev.DocumentID)
+		if prev.fromReport {
+			current, err := idMapFromInstance(prev.DocumentID)
+			if err != nil {
+				logError("Error reading document "+prev.DocumentID+": "+err.Error(), true)
+				addReport(file.Filepath, prev.DocumentID, "update", "failed", err.Error())
+				counters.updates.failed++
+				importedDocs[file.Filepath] = prev.DocumentID
+				setIDMap(file.Filepath, prev)
+				continue
+			}
+			prev = current
+		}
+		logInfo("Updating: "+file.Filepath, true)
+		prepareFile(&file)
+		file.DocumentID = prev.DocumentID
+		importedDocs[file.Filepath] = prev.DocumentID
+		updateDocument(&file, prev)
+	}
+	setLogDocument(0, "")
+
+	//Carry forward documents no longer in the CSV, so the new ID map is complete
+	for filePath, prev := range previous {
+		if !seen[filePath] {
+			if stopRequested() {
+				addReport(filePath, prev.DocumentID, "update", "not processed", "run stopped")
+			} else {
+				logInfo("Previously imported file no longer in CSV: "+filePath, false)
+				addReport(filePath, prev.DocumentID, "update", "not in csv", "")
+			}
+			importedDocs[filePath] = prev.DocumentID
+			setIDMap(filePath, prev)
+		}
+	}
+
+	csvContent = newDocs
+	if len(csvContent) > 0 {
+		processDocuments()
+	}
+}
+
+func updateDocument(file *csvStruct, prev idMapStruct) {
+	docID := prev.DocumentID
+	current := prev
+	var changes []string
+	failed := false
+	fail := func(stage string, err error) {
+		failed = true
+		logError(err.Error(), true)
+		addReport(file.Filepath, docID, stage, "failed", err.Error())
+	}
+
+	//Metadata
+	var fields []customFieldStruct
+	for _, field := range []struct{ name, old, new string }{
+		{"title", prev.Title, file.Title},
+		{"description", prev.Description, file.Description},
+		{"status", prev.Status, file.Status},
+		{"reviewDate", prev.ReviewDate, file.ReviewDate},
+	} {
+		if field.old != field.new {
+			fields = append(fields, customFieldStruct{Field: field.name, Value: field.new})
+			changes = append(changes, field.name+": "+field.old+" -> "+field.new)
+		}
+	}
+	for _, field := range file.CustomFields {
+		if old, ok := prev.Fields[field.Field]; !ok || old != field.Value {
+			fields = append(fields, field)
+			changes = append(changes, field.Field+": "+old+" -> "+field.Value)
+		}
+	}
+	if len(fields) > 0 {
+		if err := documentUpdateFields(docID, fields); err != nil {
+			fail("metadata", err)
+		} else {
+			current.Title, current.Description, current.Status, current.ReviewDate = file.Title, file.Description, file.Status, file.ReviewDate
+			current.Fields = make(map[string]string)
+			for k, v := range prev.Fields {
+				current.Fields[k] = v
+			}
+			for _, field := range fields {
+				current.Fields[field.Field] = field.Value
+			}
+			counters.updates.metadata++
+		}
+	}
+
+	//Owner
+	if file.Owner != "" && file.Owner != prev.Owner {
+		changes = append(changes, "owner: "+prev.Owner+" -> "+file.Owner)
+		if err := documentSetOwner(docID, file.Owner); err != nil {
+			counters.owners.addFailed++
+			fail("owner", err)
+		} else {
+			counters.owners.addSuccess++
+			current.Owner = file.Owner
+		}
+	}
+
+	//Content
+	hash, err := hashSource(file.Filepath)
+	switch {
+	case err != nil:
+		fail("content", err)
+	case prev.Hash == "":
+		addReport(file.Filepath, docID, "content", "not compared", "no previous hash, recorded current content")
+		current.Hash = hash
+	case hash != prev.Hash:
+		changes = append(changes, "content revised")
+		if err := documentRevise(file); err != nil {
+			fail("content", err)
+		} else {
+			current.Hash = file.ContentHash
+			counters.updates.revisions++
+		}
+	}
+
+	//Tags
+	addedTags, removedTags := diffTags(prev.Tags, csvTags[file.Filepath])
+	for _, tag := range addedTags {
+		changes = append(changes, "tag added: "+tag)
+		if err := processTag(docID, tag); err != nil {
+			fail("tag", err)
+			continue
+		}
+		current.Tags = append(current.Tags, tag)
+	}
+	for _, tag := range removedTags {
+		changes = append(changes, "tag removed: "+tag)
+		if err := removeTag(docID, tag); err != nil {
+			fail("tag", err)
+			continue
+		}
+		current.Tags = removeString(current.Tags, tag)
+	}
+
+	//Collections
+	addedColls, removedColls := diffStrings(intsToStrings(prev.Collections), intsToStrings(csvCollections[file.Filepath]))
+	for _, coll := range addedColls {
+		collectionID, _ := strconv.Atoi(coll)
+		changes = append(changes, "collection added: "+coll)
+		if err := addToCollection(docID, collectionID); err != nil {
+			fail("collection", err)
+			continue
+		}
+		current.Collections = append(current.Collections, collectionID)
+	}
+	for _, coll := range removedColls {
+		collectionID, _ := strconv.Atoi(coll)
+		changes = append(changes, "collection removed: "+coll)
+		if err := removeFromCollection(docID, collectionID); err != nil {
+			fail("collection", err)
+			continue
+		}
+		current.Collections = removeInt(current.Collections, collectionID)
+	}
+
+	//Shares, matched on URN, are re-shared when their permissions change
+	prevShares := make(map[string]sharesStruct)
+	for _, share := range prev.Shares {
+		prevShares[share.URN] = share
+	}
+	current.Shares = nil
+	for _, share := range csvShares[file.Filepath] {
+		old, ok := prevShares[share.URN]
+		delete(prevShares, share.URN)
+		if ok && old == share {
+			current.Shares = append(current.Shares, share)
+			continue
+		}
+		changes = append(changes, "share set: "+share.URN)
+		if err := shareDocument(docID, share); err != nil {
+			fail("share", err)
+			if ok {
+				current.Shares = append(current.Shares, old)
+			}
+			continue
+		}
+		current.Shares = append(current.Shares, share)
+	}
+	for _, share := range prev.Shares {
+		if _, ok := prevShares[share.URN]; !ok {
+			continue
+		}
+		changes = append(changes, "share removed: "+share.URN)
+		if err := unshareDocument(docID, share.URN); err != nil {
+			fail("share", err)
+			current.Shares = append(current.Shares, share)
+		}
+	}
+
+	setIDMap(file.Filepath, current)
+	switch {
+	case failed:
+		counters.updates.failed++
+		addReport(file.Filepath, docID, "update", "failed", strings.Join(changes, "; "))
+	case len(changes) == 0:
+		counters.updates.unchanged++
+		addReport(file.Filepath, docID, "update", "unchanged", "")
+	default:
+		counters.updates.changed++
+		addReport(file.Filepath, docID, "update", "changed", strings.Join(changes, "; "))
+	}
+}
+
+//-- Upload the file to the session and add it as a new revision of its document
+func documentRevise(file *csvStruct) error {
+	start := time.Now()
+	defer recordTiming("revision", start)
+	err := putFileInSession(file)
+	if err != nil {
+		counters.session.addFailed++
+		return err
+	}
+	counters.session.addSuccess++
+	err = documentAddRevision(file)
+	if delErr := deleteFileFromSession(file); delErr != nil {
+		logError(delErr.Error(), true)
+		counters.session.deleteFailed++
+	} else {
+		counters.session.deleteSuccess++
+	}
+	return err
+}
+
+func documentAddRevision(file *csvStruct) error {
+	logInfo("Adding Revision to Document "+file.DocumentID, false)
+	espXmlmc.SetParam("documentId", file.DocumentID)
+	espXmlmc.OpenElement("serverFile")
+	espXmlmc.SetParam("fileName", file.Filename)
+	espXmlmc.SetParam("fileSource", "/"+file.SessionPath)
+	espXmlmc.SetParam("mimeType", file.ContentType)
+	espXmlmc.CloseElement("serverFile")
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("library", "documentAddRevision", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Document Revision Added Successfully", false)
+	} else {
+		logInfo("[DRYRUN] library::documentAddRevision:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
+
+func removeTag(documentID, tag string) error {
+	tagExists, tagID, err := findTag(tag)
+	if err != nil || !tagExists {
+		return err
+	}
+	logInfo("Unlinking Tag: "+strconv.Itoa(tagID)+" from Document: "+documentID, false)
+	espXmlmc.SetParam("tagGroup", "urn:tagGroup:library")
+	espXmlmc.SetParam("tagID", strconv.Itoa(tagID))
+	espXmlmc.SetParam("objectRefUrn", "urn:lib:document:"+documentID)
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("library", "tagUnlinkObject", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Tag Unlinked Successfully", false)
+	} else {
+		logInfo("[DRYRUN] library::tagUnlinkObject:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
+
+func removeFromCollection(documentID string, collectionID int) error {
+	logInfo("Removing Document "+documentID+" from Collection "+strconv.Itoa(collectionID), false)
+	espXmlmc.SetParam("collectionId", strconv.Itoa(collectionID))
+	espXmlmc.SetParam("documentId", documentID)
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("apps/com.hornbill.docmanager/Collection", "removeFromCollection", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Document Removed from Collection Successfully", false)
+	} else {
+		logInfo("[DRYRUN] apps/com.hornbill.docmanager/Collection::removeFromCollection:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
+
+func unshareDocument(documentID, urn string) error {
+	logInfo("Removing Share of Document "+documentID+" with "+urn, false)
+	espXmlmc.SetParam("documentId", documentID)
+	espXmlmc.SetParam("share", urn)
+	//-- Check for Dry Run
+	if !flags.configDryRun {
+		err := invokeXMLMC("library", "documentUnshare", nil)
+		if err != nil {
+			return err
+		}
+		logInfo("Document Share Removed Successfully", false)
+	} else {
+		logInfo("[DRYRUN] library::documentUnshare:"+espXmlmc.GetParam(), false)
+		espXmlmc.ClearParam()
+	}
+	return nil
+}
+
+//-- Returns the values in b that are not in a, and those in a that are not in b
+func diffStrings(a, b []string) ([]string, []string) {
+	inA := make(map[string]bool)
+	inB := make(map[string]bool)
+	for _, v := range a {
+		inA[v] = true
+	}
+	for _, v := range b {
+		inB[v] = true
+	}
+	var added, removed []string
+	for v := range inB {
+		if !inA[v] {
+			added = append(added, v)
+		}
+	}
+	for v := range inA {
+		if !inB[v] {
+			removed = append(removed, v)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+//-- Returns the tags in b that are not in a, and those in a that are not in b, matched by -tagmatch
+func diffTags(a, b []string) ([]string, []string) {
+	inA := make(map[string]bool)
+	inB := make(map[string]bool)
+	for _, tag := range a {
+		inA[tagKey(tag)] = true
+	}
+	for _, tag := range b {
+		inB[tagKey(tag)] = true
+	}
+	var added, removed []string
+	for _, tag := range b {
+		if !inA[tagKey(tag)] {
+			added = append(added, tag)
+			inA[tagKey(tag)] = true
+		}
+	}
+	for _, tag := range a {
+		if !inB[tagKey(tag)] {
+			removed = append(removed, tag)
+			inB[tagKey(tag)] = true
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func intsToStrings(ints []int) []string {
+	var strs []string
+	for _, i := range ints {
+		strs = append(strs, strconv.Itoa(i))
+	}
+	return strs
+}
+
+func removeString(list []string, value string) []string {
+	var out []string
+	for _, v := range list {
+		if v != value {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func removeInt(list []int, value int) []int {
+	var out []int
+	for _, v := range list {
+		if v != value {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//-- Subfolders of each watched folder that processed files are moved into
+const (
+	watchDoneDir   = "done"
+	watchFailedDir = "failed"
+	watchResult    = ".result.json"
+)
+
+//-- Metadata given to the files dropped into a watched folder
+type watchDefaultsStruct struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Status      string         `json:"status"`
+	ReviewDate  string         `json:"reviewDate"`
+	Owner       string         `json:"owner"`
+	Tags        []string       `json:"tags"`
+	Collections []int          `json:"collections"`
+	Shares      []sharesStruct `json:"shares"`
+}
+
+//-- A file taken from a watched folder. DocumentID is blank until the import has finished,
+//-- so an entry without one found at startup means the previous run stopped part way through
+type watchStateStruct struct {
+	Hash       string    `json:"hash"`
+	DocumentID string    `json:"documentId,omitempty"`
+	Started    time.Time `json:"started"`
+}
+
+//-- Result sidecar written next to each processed file
+type watchResultStruct struct {
+	Filepath   string         `json:"filepath"`
+	DocumentID string         `json:"documentId,omitempty"`
+	Outcome    string         `json:"outcome"`
+	Processed  time.Time      `json:"processed"`
+	Stages     []reportStruct `json:"stages"`
+}
+
+//-- Size and modified time of a file when it was last polled
+type watchSeenStruct struct {
+	Size    int64
+	ModTime time.Time
+}
+
+var (
+	watchDefaults = make(map[string]watchDefaultsStruct)
+	watchState    = make(map[string]watchStateStruct)
+)
+
+//-- Load the per-folder defaults, keyed by watched folder
+func loadWatchDefaults(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	defaults := make(map[string]watchDefaultsStruct)
+	err = json.Unmarshal(content, &defaults)
+	if err != nil {
+		return err
+	}
+	for folder, folderDefaults := range defaults {
+		watchDefaults[filepath.Clean(folder)] = folderDefaults
+	}
+	return nil
+}
+
+func loadWatchState(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, &watchState)
+}
+
+func saveWatchState(filename string) error {
+	content, err := json.MarshalIndent(watchState, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+//-- Poll the -watch folders, importing each file once it has stopped changing for -watchsettle seconds.
+//-- Runs until the process is stopped
+func watchFolders() error {
+	var folders []string
+	for _, folder := range strings.Split(flags.configWatch, ",") {
+		folder = filepath.Clean(strings.TrimSpace(folder))
+		info, err := os.Stat(folder)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errors.New("not a folder: " + folder)
+		}
+		folders = append(folders, folder)
+	}
+	err := loadWatchState(flags.configWatchState)
+	if err != nil {
+		return errors.New("error loading watch state " + flags.configWatchState + ": " + err.Error())
+	}
+	watchRecover()
+
+	settle := time.Duration(flags.configWatchSettle) * time.Second
+	interval := time.Duration(flags.configWatchInterval) * time.Second
+	seen := make(map[string]watchSeenStruct)
+	//Files already taken that are still in the folder, such as when a move failed, by size and time, so
+	//they are not imported again unless they change
+	handled := make(map[string]watchSeenStruct)
+	logInfo("Watching "+strings.Join(folders, ", ")+" every "+interval.String()+", importing files unchanged for "+settle.String(), true)
+	for {
+		polled := make(map[string]watchSeenStruct)
+		stillHandled := make(map[string]watchSeenStruct)
+		for _, folder := range folders {
+			for _, filePath := range scanWatchFolder(folder) {
+				info, err := os.Stat(filePath)
+				if err != nil {
+					continue
+				}
+				current := watchSeenStruct{Size: info.Size(), ModTime: info.ModTime()}
+				if handled[filePath] == current || watchState[filePath].DocumentID != "" {
+					stillHandled[filePath] = current
+					continue
+				}
+				polled[filePath] = current
+				if seen[filePath] != current || time.Since(current.ModTime) < settle {
+					continue
+				}
+				waitToContinue()
+				if stopRequested() {
+					break
+				}
+				watchImport(folder, filePath)
+				stillHandled[filePath] = current
+			}
+		}
+		seen, handled = polled, stillHandled
+		err = flushReport()
+		if err != nil {
+			logError("Error writing report "+flags.configReport+": "+err.Error(), true)
+		}
+		select {
+		case <-shutdown:
+			logInfo("Stopped watching "+strings.Join(folders, ", "), true)
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+//-- List the files waiting in a watched folder, leaving out the done and failed folders and any sidecars
+func scanWatchFolder(folder string) []string {
+	var files []string
+	filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logError("Error scanning "+path+": "+err.Error(), false)
+			return nil
+		}
+		if info.IsDir() {
+			if path != folder && (info.Name() == watchDoneDir || info.Name() == watchFailedDir) && filepath.Dir(path) == folder {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") || (flags.configSidecars && isSidecar(path)) {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+//-- Import a single settled file with its folder's defaults, then move it to done or failed
+func watchImport(folder, filePath string) {
+	hash, err := hashSource(filePath)
+	if err != nil {
+		logError("Error reading "+filePath+": "+err.Error(), true)
+		return
+	}
+	watchState[filePath] = watchStateStruct{Hash: hash, Started: time.Now()}
+	saveWatchStateOrLog()
+
+	defaults := watchDefaults[folder]
+	file := csvStruct{
+		Filepath:    filePath,
+		Title:       defaults.Title,
+		Description: defaults.Description,
+		Status:      defaults.Status,
+		ReviewDate:  defaults.ReviewDate,
+		Owner:       defaults.Owner,
+	}
+	if file.Status == "" {
+		file.Status = flags.configCrawlStatus
+	}
+	csvTags[filePath] = append([]string(nil), defaults.Tags...)
+	csvCollections[filePath] = append([]int(nil), defaults.Collections...)
+	csvShares[filePath] = append([]sharesStruct(nil), defaults.Shares...)
+	if flags.configSidecars {
+		applySidecars(&file)
+	}
+
+	firstRow := reportLen()
+	delete(importedDocs, filePath)
+	csvContent = []csvStruct{file}
+	processDocuments()
+	docID := importedDocs[filePath]
+	delete(importedDocs, filePath)
+
+	outcome := watchFailedDir
+	if docID != "" {
+		outcome = watchDoneDir
+		watchState[filePath] = watchStateStruct{Hash: hash, DocumentID: docID, Started: watchState[filePath].Started}
+		saveWatchStateOrLog()
+	}
+	watchFinish(folder, filePath, watchResultStruct{
+		Filepath:   filePath,
+		DocumentID: docID,
+		Outcome:    outcome,
+		Processed:  time.Now(),
+		Stages:     reportSince(firstRow),
+	})
+	delete(csvTags, filePath)
+	delete(csvCollections, filePath)
+	delete(csvShares, filePath)
+}
+
+//-- Move a processed file, and its sidecars, into the done or failed folder and write its result sidecar there
+func watchFinish(folder, filePath string, result watchResultStruct) {
+	if flags.configDryRun {
+		logInfo("[DRYRUN] Would move "+filePath+" to "+filepath.Join(folder, result.Outcome), true)
+		delete(watchState, filePath)
+		return
+	}
+	rel, err := filepath.Rel(folder, filePath)
+	if err != nil {
+		rel = filepath.Base(filePath)
+	}
+	destination := filepath.Join(folder, result.Outcome, rel)
+	if _, err := os.Stat(destination); err == nil {
+		ext := filepath.Ext(destination)
+		destination = strings.TrimSuffix(destination, ext) + "_" + time.Now().Format("20060102150405") + ext
+	}
+	err = os.MkdirAll(filepath.Dir(destination), 0755)
+	if err == nil {
+		err = os.Rename(filePath, destination)
+	}
+	if err != nil {
+		logError("Error moving "+filePath+" to "+destination+": "+err.Error(), true)
+		return
+	}
+	if flags.configSidecars {
+		for _, suffix := range sidecarSuffixes {
+			if _, err := os.Stat(filePath + suffix); err == nil {
+				err = os.Rename(filePath+suffix, destination+suffix)
+				if err != nil {
+					logError("Error moving "+filePath+suffix+": "+err.Error(), true)
+				}
+			}
+		}
+	}
+	content, err := json.MarshalIndent(result, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(destination+watchResult, content, 0644)
+	}
+	if err != nil {
+		logError("Error writing result for "+destination+": "+err.Error(), true)
+	}
+	logInfo("Moved "+filePath+" to "+destination, true)
+	delete(watchState, filePath)
+	saveWatchStateOrLog()
+}
+
+//-- Deal with files a previous run took but did not finish. Files already imported are moved to done
+//-- without importing them again. Files stopped part way through are moved to failed, as the document
+//-- may exist, to be checked in the library before the file is dropped in again
+func watchRecover() {
+	var pending []string
+	for filePath := range watchState {
+		pending = append(pending, filePath)
+	}
+	sort.Strings(pending)
+	for _, filePath := range pending {
+		entry := watchState[filePath]
+		if _, err := os.Stat(filePath); err != nil {
+			delete(watchState, filePath)
+			continue
+		}
+		folder := watchFolderOf(filePath)
+		result := watchResultStruct{Filepath: filePath, DocumentID: entry.DocumentID, Processed: time.Now()}
+		hash, _ := hashSource(filePath)
+		switch {
+		case entry.DocumentID != "" && hash == entry.Hash:
+			logInfo("Already imported before restart: "+filePath+" ("+entry.DocumentID+")", true)
+			result.Outcome = watchDoneDir
+			addReport(filePath, entry.DocumentID, "watch", "recovered", "imported before restart")
+		case entry.DocumentID != "":
+			//Replaced with new content since it was imported, so import it again
+			delete(watchState, filePath)
+			continue
+		default:
+			logError("Import of "+filePath+" was interrupted, check the library before dropping it in again", true)
+			result.Outcome = watchFailedDir
+			addReport(filePath, "", "watch", "failed", "interrupted by restart")
+		}
+		result.Stages = reportSince(reportLen() - 1)
+		watchFinish(folder, filePath, result)
+	}
+	saveWatchStateOrLog()
+}
+
+//-- The -watch folder a file sits under
+func watchFolderOf(filePath string) string {
+	best := ""
+	for _, folder := range strings.Split(flags.configWatch, ",") {
+		folder = filepath.Clean(strings.TrimSpace(folder))
+		if strings.HasPrefix(filePath, folder+string(filepath.Separator)) && len(folder) > len(best) {
+			best = folder
+		}
+	}
+	if best == "" {
+		return filepath.Dir(filePath)
+	}
+	return best
+}
+
+func saveWatchStateOrLog() {
+	if flags.configDryRun {
+		return
+	}
+	err := saveWatchState(flags.configWatchState)
+	if err != nil {
+		logError("Error writing watch state "+flags.configWatchState+": "+err.Error(), true)
+	}
+}
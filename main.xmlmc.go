@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//-- An instance documents are read from: the target, or the -mode migrate source
+type instanceStruct struct {
+	xmlmc  *apiLib.XmlmcInstStruct
+	id     string
+	apiKey string
+}
+
+//-- The -sourceinstanceid connection, set up for -mode migrate
+var sourceInstance instanceStruct
+
+func targetInstance() instanceStruct {
+	return instanceStruct{xmlmc: espXmlmc, id: flags.configInstanceID, apiKey: flags.configAPIKey}
+}
+
+func newInstance(id, apiKey string) instanceStruct {
+	xmlmc := apiLib.NewXmlmcInstance(id)
+	xmlmc.SetAPIKey(apiKey)
+	xmlmc.SetTimeout(flags.configAPITimeout)
+	return instanceStruct{xmlmc: xmlmc, id: id, apiKey: apiKey}
+}
+
+//-- A method failure the instance answered with, as opposed to a failed connection or HTTP error
+type xmlmcError struct {
+	code    string
+	message string
+}
+
+func (e *xmlmcError) Error() string {
+	return e.message
+}
+
+//-- Invoke an XMLMC method on the target instance using the params already set against espXmlmc
+func invokeXMLMC(service, method string, response interface{}) error {
+	return invokeXMLMCOn(espXmlmc, service, method, response)
+}
+
+//-- Invoke an XMLMC method using the params already set against the connection, retrying failed
+//-- connections for read methods only, as a write may have succeeded before the connection failed,
+//-- then unmarshal the response in to the given struct and check the method result
+func invokeXMLMCOn(espXmlmc *apiLib.XmlmcInstStruct, service, method string, response interface{}) (err error) {
+	logDebug("["+service+"::"+method+"] "+espXmlmc.GetParam(), false)
+	start := time.Now()
+	attempts := 1
+	defer func() {
+		duration := time.Since(start)
+		logAPICall(service, method, duration, attempts, err)
+		outcome := "ok"
+		if err != nil {
+			outcome = "failed"
+		}
+		metricAdd("docimport_api_calls_total", 1, "service", service, "method", method, "outcome", outcome)
+		metricObserve("docimport_api_call_duration_seconds", duration, "service", service, "method", method)
+		if attempts > 1 {
+			metricAdd("docimport_api_retries_total", float64(attempts-1), "service", service, "method", method)
+		}
+	}()
+	rateWaitCall(method)
+	XMLResponse, err := espXmlmc.Invoke(service, method)
+	for attempt := 1; err != nil && isReadMethod(method) && attempt <= flags.configRetries; attempt++ {
+		attempts++
+		throttleRecord(invokeStatusError(espXmlmc, err))
+		logError("["+service+"::"+method+"] attempt "+strconv.Itoa(attempt)+" failed: "+err.Error(), false)
+		time.Sleep(time.Duration(attempt) * time.Duration(flags.configRetryDelay) * time.Second)
+		rateWaitCall(method)
+		XMLResponse, err = espXmlmc.Invoke(service, method)
+	}
+	if err != nil {
+		err = invokeStatusError(espXmlmc, err)
+		throttleRecord(err)
+		espXmlmc.ClearParam()
+		return err
+	}
+	logDebug("[RESPONSE] "+flattenXML(XMLResponse), false)
+
+	var xmlmcResponse xmlmcResponseStruct
+	err = xml.Unmarshal([]byte(XMLResponse), &xmlmcResponse)
+	if err != nil {
+		return err
+	}
+	if xmlmcResponse.MethodResult != "ok" {
+		err = &xmlmcError{code: xmlmcResponse.State.Code, message: xmlmcResponse.State.ErrorRet}
+		throttleRecord(err)
+		return err
+	}
+	throttleRecord(nil)
+	if response != nil {
+		return xml.Unmarshal([]byte(XMLResponse), response)
+	}
+	return nil
+}